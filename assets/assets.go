@@ -0,0 +1,211 @@
+package assets
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/falling-sky/fsbuilder/config"
+)
+
+// reATTR matches src="..." and href="..." in html, or with single quotes.
+// reURL matches url(...) in css, with or without quotes.
+var reATTR = regexp.MustCompile(`(?i)\b(?:src|href)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+var reURL = regexp.MustCompile(`(?i)\burl\(\s*['"]?([^'")]*)['"]?\s*\)`)
+
+// reINTEGRITYATTR matches an integrity attribute.
+var reINTEGRITYATTR = regexp.MustCompile(`(?i)\sintegrity\s*=`)
+
+// Reference is a single asset reference found in generated content.
+// Start and End are the byte offsets of Path within the content.
+type Reference struct {
+	Path  string // ie /index.js
+	Start int
+	End   int
+}
+
+// Scan finds local asset references (scripts, stylesheets, images) in
+// content.  Only site-absolute paths such as "/index.js" are returned;
+// relative, protocol-relative and external URLs are left alone.
+// Any ?query or #fragment is not considered part of Path.
+func Scan(content string) []Reference {
+	found := []Reference{}
+	for _, re := range []*regexp.Regexp{reATTR, reURL} {
+		for _, m := range re.FindAllStringSubmatchIndex(content, -1) {
+			start, end := m[2], m[3]
+			if start < 0 {
+				start, end = m[4], m[5] // Single quoted
+			}
+			p := content[start:end]
+			if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") {
+				continue
+			}
+			if i := strings.IndexAny(p, "?#"); i >= 0 {
+				p = p[:i]
+				end = start + i
+			}
+			found = append(found, Reference{Path: p, Start: start, End: end})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Start < found[j].Start })
+	return found
+}
+
+// Graph records which assets each generated page references.
+// It is safe for concurrent use by the job queue.
+type Graph struct {
+	lock   sync.RWMutex
+	byPage map[string]map[string]bool
+}
+
+// NewGraph returns an empty Graph.
+func NewGraph() *Graph {
+	return &Graph{byPage: make(map[string]map[string]bool)}
+}
+
+// Add records that page references asset.
+func (g *Graph) Add(page string, asset string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.byPage[page] == nil {
+		g.byPage[page] = make(map[string]bool)
+	}
+	g.byPage[page][asset] = true
+}
+
+// Missing returns the assets that known rejects, with the sorted list of
+// pages referencing each; ie a typo in a template, or an asset that was
+// not built.
+func (g *Graph) Missing(known func(asset string) bool) map[string][]string {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	ret := make(map[string][]string)
+	for page, refs := range g.byPage {
+		for asset := range refs {
+			if !known(asset) {
+				ret[asset] = append(ret[asset], page)
+			}
+		}
+	}
+	for _, pages := range ret {
+		sort.Strings(pages)
+	}
+	return ret
+}
+
+// Exists reports whether asset was written to outputDir; either as is,
+// or per locale (ie index.html.fr_FR).
+func Exists(outputDir string, asset string) bool {
+	fn := outputDir + "/" + strings.TrimPrefix(asset, "/")
+	if _, err := os.Stat(fn); err == nil {
+		return true
+	}
+	variants, _ := filepath.Glob(fn + ".*")
+	return len(variants) > 0
+}
+
+// Rewriter applies the configured rewrite rules to asset references,
+// recording every reference it sees in Graph.
+type Rewriter struct {
+	Rules    []config.RewriteRule
+	Graph    *Graph
+	Manifest *Manifest
+
+	// Built maps the extension of assets built from templates (ie ".js")
+	// to the template directory building them; their hashed names are
+	// only known once every job of that directory has finished.
+	Built map[string]string
+}
+
+// NewRewriter returns a Rewriter for the given rules, with an empty
+// Graph and Manifest.
+func NewRewriter(rules []config.RewriteRule) *Rewriter {
+	return &Rewriter{
+		Rules:    rules,
+		Graph:    NewGraph(),
+		Manifest: NewManifest(),
+		Built:    make(map[string]string),
+	}
+}
+
+// Rule returns the first rule matching the asset path, or nil.
+func (r *Rewriter) Rule(asset string) *config.RewriteRule {
+	for i := range r.Rules {
+		if ok, _ := path.Match(r.Rules[i].Match, asset); ok {
+			return &r.Rules[i]
+		}
+	}
+	return nil
+}
+
+// Resolve returns the reference that should be written for asset.
+// compressed is true when generating the .gz variant of a page.
+func (r *Rewriter) Resolve(asset string, compressed bool) string {
+	rule := r.Rule(asset)
+	if rule == nil {
+		return asset
+	}
+	ref := asset
+	if rule.Fingerprint {
+		ref = r.Manifest.Lookup(ref)
+	}
+	if rule.Compressed && compressed {
+		ref = ref + ".gz"
+	}
+	return rule.Prefix + ref
+}
+
+// Seal calculates the hashed name of every asset added to the Manifest
+// whose rule asks for a Fingerprint; so that Link copies just those.
+func (r *Rewriter) Seal() {
+	for _, logical := range r.Manifest.Assets() {
+		if rule := r.Rule(logical); rule != nil && rule.Fingerprint {
+			r.Manifest.Lookup(logical)
+		}
+	}
+}
+
+// hasIntegrity reports whether the tag around offset has an integrity
+// attribute.
+func hasIntegrity(content string, offset int) bool {
+	start := strings.LastIndex(content[:offset], "<")
+	end := strings.Index(content[offset:], ">")
+	if start < 0 || end < 0 || strings.Contains(content[start:offset], ">") {
+		return false
+	}
+	return reINTEGRITYATTR.MatchString(content[start : offset+end])
+}
+
+// Rewrite records the assets referenced by page, and returns content with
+// those references rewritten according to the rules.  locale is the
+// page's: a reference with an integrity attribute to an asset built per
+// locale points at that locale's file (ie /index.js.fr_FR), as the digest
+// is that file's; the negotiated /index.js may serve another.
+func (r *Rewriter) Rewrite(page string, content string, compressed bool, locale string) string {
+	refs := Scan(content)
+	if len(refs) == 0 {
+		return content
+	}
+
+	b := &strings.Builder{}
+	last := 0
+	for _, ref := range refs {
+		if ref.Start < last {
+			continue // Overlapping match, ie url() inside an attribute.
+		}
+		logical := r.Manifest.Logical(ref.Path)
+		r.Graph.Add(page, logical)
+		b.WriteString(content[last:ref.Start])
+		b.WriteString(r.Resolve(logical, compressed))
+		if locale != "" && r.Manifest.PerLocale(logical) && hasIntegrity(content, ref.Start) {
+			b.WriteString("." + locale)
+		}
+		last = ref.End
+	}
+	b.WriteString(content[last:])
+	return b.String()
+}
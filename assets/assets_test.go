@@ -0,0 +1,163 @@
+package assets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/falling-sky/fsbuilder/config"
+)
+
+func TestScan(t *testing.T) {
+	content := `<script src="/index.js?v=1"></script>
+<link rel="stylesheet" href="/index.css">
+<a href="http://example.com/">x</a> <img src="images/relative.png">
+<style>body { background: url('/images/bg.png'); }</style>
+<img src='/images/logo.png' alt="">`
+
+	refs := Scan(content)
+	want := []string{"/index.js", "/index.css", "/images/bg.png", "/images/logo.png"}
+	if len(refs) != len(want) {
+		t.Fatalf("Scan found %#v, expected %v", refs, want)
+	}
+	for i, ref := range refs {
+		if ref.Path != want[i] {
+			t.Errorf("ref %d: got %v, expected %v", i, ref.Path, want[i])
+		}
+		if content[ref.Start:ref.End] != ref.Path {
+			t.Errorf("ref %d: offsets point at %q", i, content[ref.Start:ref.End])
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	r := NewRewriter([]config.RewriteRule{
+		{Match: "/index.js", Compressed: true},
+		{Match: "/images/*", Prefix: "https://cdn.example.com"},
+		{Match: "/*.css", Compressed: true, Fingerprint: true},
+	})
+	r.Manifest.AddContent("/index.css", "index.css", []byte("body {}"))
+	r.Manifest.Seal()
+	hashed := r.Manifest.Lookup("/index.css")
+	if hashed == "/index.css" {
+		t.Fatal("Manifest.Lookup(/index.css) was not fingerprinted")
+	}
+
+	var table = []struct {
+		in         string
+		compressed bool
+		out        string
+	}{
+		{`<script src="/index.js?v=1">`, false, `<script src="/index.js?v=1">`},
+		{`<script src="/index.js?v=1">`, true, `<script src="/index.js.gz?v=1">`},
+		{`<img src="/images/a.png">`, true, `<img src="https://cdn.example.com/images/a.png">`},
+		{`<a href="/faq.html">`, true, `<a href="/faq.html">`},
+		{`<link href="/index.css">`, false, `<link href="` + hashed + `">`},
+		{`<link href="` + hashed + `">`, true, `<link href="` + hashed + `.gz">`},
+	}
+	for _, tt := range table {
+		found := r.Rewrite("index.html", tt.in, tt.compressed, "")
+		if found != tt.out {
+			t.Errorf("Rewrite(%q,%v)=%q, expected %q", tt.in, tt.compressed, found, tt.out)
+		}
+	}
+
+	r.Rewrite("faq.html", `<img src="/images/a.png">`, false, "")
+	missing := r.Graph.Missing(func(asset string) bool { return asset != "/images/a.png" })
+	if len(missing) != 1 || fmt.Sprint(missing["/images/a.png"]) != "[faq.html index.html]" {
+		t.Errorf("Graph.Missing=%v, expected /images/a.png from faq.html and index.html", missing)
+	}
+}
+
+func TestExists(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir+"/site.css", []byte("body {}"), 0644)
+	ioutil.WriteFile(dir+"/index.html.fr_FR", []byte("<p>"), 0644)
+	for asset, expected := range map[string]bool{"/site.css": true, "/index.html": true, "/": true, "/missing.js": false} {
+		if got := Exists(dir, asset); got != expected {
+			t.Errorf("Exists(%s)=%v, expected %v", asset, got, expected)
+		}
+	}
+}
+
+func TestRewriteLocale(t *testing.T) {
+	r := NewRewriter([]config.RewriteRule{{Match: "/index.js", Compressed: true, Fingerprint: true}})
+	for _, locale := range []string{"en_US", "fr_FR"} {
+		r.Manifest.AddContent("/index.js", "index.js."+locale, []byte(locale))
+		r.Manifest.AddIntegrity("/index.js", locale, []byte(locale))
+	}
+	r.Manifest.AddIntegrity("/site.css", "", []byte("body {}"))
+	hashed := r.Manifest.Lookup("/index.js")
+
+	var table = []struct {
+		in         string
+		compressed bool
+		out        string
+	}{
+		{`<script src="/index.js" integrity="sha384-x">`, false, `<script src="` + hashed + `.fr_FR" integrity="sha384-x">`},
+		{`<script integrity="sha384-x" src="/index.js?v=1">`, true, `<script integrity="sha384-x" src="` + hashed + `.gz.fr_FR?v=1">`},
+		{`<script src="/index.js"></script><p integrity>`, false, `<script src="` + hashed + `"></script><p integrity>`},
+		{`<link href="/site.css" integrity="sha384-y">`, false, `<link href="/site.css" integrity="sha384-y">`},
+	}
+	for _, tt := range table {
+		if found := r.Rewrite("index.html", tt.in, tt.compressed, "fr_FR"); found != tt.out {
+			t.Errorf("Rewrite(%q,%v)=%q, expected %q", tt.in, tt.compressed, found, tt.out)
+		}
+	}
+}
+
+func TestSeal(t *testing.T) {
+	dir := t.TempDir()
+	r := NewRewriter([]config.RewriteRule{
+		{Match: "/index.js", Compressed: true},
+		{Match: "/*.css", Fingerprint: true},
+	})
+	for _, fn := range []string{"index.js", "index.css"} {
+		ioutil.WriteFile(dir+"/"+fn, []byte(fn), 0644)
+		r.Manifest.AddContent("/"+fn, fn, []byte(fn))
+	}
+	r.Seal()
+	if err := r.Manifest.Link(dir); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(dir + "/*")
+	if len(files) != 3 {
+		t.Errorf("Link wrote %v, expected just a hashed index.css", files)
+	}
+}
+
+func TestFingerprintName(t *testing.T) {
+	var table = []struct {
+		in  string
+		out string
+	}{
+		{"/index.js", "/index.abc.js"},
+		{"/images/logo.png", "/images/logo.abc.png"},
+		{"/robots", "/robots.abc"},
+	}
+	for _, tt := range table {
+		if found := FingerprintName(tt.in, "abc"); found != tt.out {
+			t.Errorf("FingerprintName(%v)=%v, expected %v", tt.in, found, tt.out)
+		}
+	}
+}
+
+func TestLookupIntegrity(t *testing.T) {
+	m := NewManifest()
+	m.AddIntegrity("/index.js", "fr_FR", []byte("fr"))
+	m.AddIntegrity("/index.css", "", []byte("css"))
+
+	if s, ok := m.LookupIntegrity("/index.js", "fr_FR"); !ok || s != Integrity([]byte("fr")) {
+		t.Errorf("LookupIntegrity(/index.js,fr_FR)=%v,%v", s, ok)
+	}
+	if _, ok := m.LookupIntegrity("/index.js", "de_DE"); ok {
+		t.Errorf("LookupIntegrity(/index.js,de_DE) should not be found")
+	}
+	if s, ok := m.LookupIntegrity("/index.css", "de_DE"); !ok || s != Integrity([]byte("css")) {
+		t.Errorf("LookupIntegrity(/index.css,de_DE)=%v,%v", s, ok)
+	}
+	if s := Integrity([]byte("")); s != "sha384-OLBgp1GsljhM2TJ+sbHjaiH9txEUvgdDTAzHv2P24donTt6/529l+9Ua0vFImLlb" {
+		t.Errorf("Integrity('')=%v", s)
+	}
+}
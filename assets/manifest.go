@@ -0,0 +1,250 @@
+package assets
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/falling-sky/fsbuilder/fileutil"
+)
+
+// HashLength is how many hex digits of the content hash go into a name.
+const HashLength = 8
+
+// Manifest maps logical asset paths (ie /index.js) to content-hashed
+// paths (ie /index.3f2a9c01.js).  Outputs are added as they are written.
+// The hashed name is calculated on first lookup, so callers must make sure
+// every variant of an asset has been written before asking for it.
+type Manifest struct {
+	lock    sync.RWMutex
+	content map[string]map[string]string // logical -> output file -> content hash
+	hashed  map[string]string            // logical -> hashed
+	logical map[string]string            // hashed -> logical
+	sri     map[string]map[string]string // logical -> locale -> integrity
+}
+
+// NewManifest returns an empty Manifest.
+func NewManifest() *Manifest {
+	return &Manifest{
+		content: make(map[string]map[string]string),
+		hashed:  make(map[string]string),
+		logical: make(map[string]string),
+		sri:     make(map[string]map[string]string),
+	}
+}
+
+// Integrity returns the Subresource Integrity value (sha384-...) for
+// content, as used by <script integrity="..."> and <link integrity="...">.
+func Integrity(content []byte) string {
+	sum := sha512.Sum384(content)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// FingerprintName inserts hash before the extension of name;
+// ie "/index.js" becomes "/index.3f2a9c01.js".
+func FingerprintName(name string, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// AddContent records one output file (relative to the output directory)
+// as a variant of the logical asset.  Locale and .gz variants of the same
+// asset all contribute to a single hash.
+func (m *Manifest) AddContent(logical string, file string, content []byte) {
+	sum := sha256.Sum256(content)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.content[logical] == nil {
+		m.content[logical] = make(map[string]string)
+	}
+	m.content[logical][file] = fmt.Sprintf("%x", sum)
+	if hashed, ok := m.hashed[logical]; ok {
+		delete(m.logical, hashed)
+		delete(m.hashed, logical)
+	}
+}
+
+// AddIntegrity records the SRI digest of the final, uncompressed content
+// of a logical asset.  locale is "" for assets that are not per-locale.
+func (m *Manifest) AddIntegrity(logical string, locale string, content []byte) {
+	digest := Integrity(content)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.sri[logical] == nil {
+		m.sri[logical] = make(map[string]string)
+	}
+	m.sri[logical][locale] = digest
+}
+
+// LookupIntegrity returns the SRI digest of a logical asset as served to
+// locale; falling back to the digest of the asset that is not per-locale.
+// Returns false if the asset was never recorded.
+func (m *Manifest) LookupIntegrity(logical string, locale string) (string, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	byLocale, ok := m.sri[logical]
+	if !ok {
+		return "", false
+	}
+	if s, ok := byLocale[locale]; ok {
+		return s, true
+	}
+	s, ok := byLocale[""]
+	return s, ok
+}
+
+// PerLocale reports whether a logical asset is built for each locale
+// (see AddIntegrity); its URL is then content negotiated, and serves
+// whichever locale the browser asks for.
+func (m *Manifest) PerLocale(logical string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	byLocale, ok := m.sri[logical]
+	if !ok {
+		return false
+	}
+	_, shared := byLocale[""]
+	return !shared
+}
+
+// AddDir records every file below outputDir/dir, using "/dir/file" as the
+// logical name.  Dot files (ie .htaccess) are skipped.
+func (m *Manifest) AddDir(outputDir string, dir string) error {
+	files, err := fileutil.FilesInDirRecursive(outputDir + "/" + dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if strings.HasPrefix(path.Base(f), ".") {
+			continue
+		}
+		b, err := ioutil.ReadFile(outputDir + "/" + dir + "/" + f)
+		if err != nil {
+			return err
+		}
+		m.AddContent("/"+dir+"/"+f, dir+"/"+f, b)
+		m.AddIntegrity("/"+dir+"/"+f, "", b)
+	}
+	return nil
+}
+
+// seal calculates the hashed name of a logical asset.
+// The caller must hold the write lock.
+func (m *Manifest) seal(logical string) (string, bool) {
+	if hashed, ok := m.hashed[logical]; ok {
+		return hashed, true
+	}
+	files, ok := m.content[logical]
+	if !ok {
+		return "", false
+	}
+	names := []string{}
+	for f := range files {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, f := range names {
+		io.WriteString(h, f+"\x00"+files[f]+"\n")
+	}
+	hashed := FingerprintName(logical, fmt.Sprintf("%x", h.Sum(nil))[:HashLength])
+	m.hashed[logical] = hashed
+	m.logical[hashed] = logical
+	return hashed, true
+}
+
+// Seal calculates the hashed name of every logical asset added so far.
+func (m *Manifest) Seal() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for logical := range m.content {
+		m.seal(logical)
+	}
+}
+
+// Assets returns every logical asset added so far, sorted.
+func (m *Manifest) Assets() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	ret := []string{}
+	for logical := range m.content {
+		ret = append(ret, logical)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Lookup returns the hashed name for a logical asset; or the logical
+// name itself if the asset is unknown.
+func (m *Manifest) Lookup(logical string) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if s, ok := m.seal(logical); ok {
+		return s
+	}
+	return logical
+}
+
+// Logical is the reverse of Lookup.  Names that are not hashed names
+// are returned unchanged.
+func (m *Manifest) Logical(name string) string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if s, ok := m.logical[name]; ok {
+		return s
+	}
+	return name
+}
+
+// Link writes a copy of every recorded output file under its hashed name;
+// ie index.js.gz.fr_FR is copied to index.3f2a9c01.js.gz.fr_FR.  Only
+// assets that were sealed (or looked up) have a hashed name.
+func (m *Manifest) Link(outputDir string) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for logical, files := range m.content {
+		hashed, ok := m.hashed[logical]
+		if !ok {
+			continue
+		}
+		from := strings.TrimPrefix(logical, "/")
+		to := strings.TrimPrefix(hashed, "/")
+		for f := range files {
+			if !strings.HasPrefix(f, from) {
+				continue
+			}
+			b, err := ioutil.ReadFile(outputDir + "/" + f)
+			if err != nil {
+				return err
+			}
+			dest := outputDir + "/" + to + strings.TrimPrefix(f, from)
+			os.MkdirAll(filepath.Dir(dest), 0755)
+			if err = ioutil.WriteFile(dest, b, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Save writes the logical to hashed mapping as JSON.
+func (m *Manifest) Save(fn string) error {
+	m.lock.RLock()
+	b, err := json.MarshalIndent(m.hashed, "", "\t")
+	m.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn, b, 0644)
+}
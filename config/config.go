@@ -3,8 +3,9 @@ package config
 import (
 	"bytes"
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
 	"log"
+	"strings"
 )
 
 // Record contains configuration options
@@ -16,8 +17,16 @@ type Record struct {
 		PoDir          string
 		OutputDir      string
 	}
+	// Processors are shell commands run (in OutputDir) on each generated
+	// file.  Macros available:
+	// [NAME] will simply be index.html.en_US, index.js.en_US, or comment.php
+	// [NAMEGZ] will simply be index.html.gz.en_US, index.js.gz.en_US, or comment.php.gz
+	// [INPUT] will be identical to [NAME].orig - and is written to disk at the start of the commands.
+	// [OUTPUT] will be identical to [NAME]
+	// With no commands, the file is written (and compressed) by the builder
+	// itself; otherwise the commands must write [OUTPUT], ie mv [INPUT] [OUTPUT].
 	Processors struct {
-		Note   []string
+		Note   []string `json:",omitempty"` // Ignored; kept so that older configs still load
 		JS     []string
 		CSS    []string
 		HTML   []string
@@ -25,9 +34,50 @@ type Record struct {
 		Apache []string
 	}
 	Map     map[string]string
+	Rewrite []RewriteRule
+	Crowdin CrowdinConfig
+	Sitemap struct {
+		BaseURL string   // ie "https://test-ipv6.com"; sitemap.xml is only written if set
+		Robots  []string // Lines of robots.txt
+	}
 	Options struct {
-		MaxThreads int
+		MaxThreads    int
+		Env           []string // Environment variables templates may read with env
+		AutoSegment   bool     // Translate html text even without {{ }}
+		Pseudo        bool     // Also build the qps_PLOC and qps_PLOCM pseudo-locales
+		MinTranslated int      // Percent; locales translated less are not published
+		MinApproved   int      // Percent; locales approved less on Crowdin (at any workflow review step) are not published
+		Locales       []string // Locales to build, besides en_US; all of them if empty
 	}
+
+	Profile  string             // Profile to build (see Profiles), ie with -profile; "" for none
+	Vars     map[string]string  // For templates, as .Profile.Vars
+	Profiles map[string]*Record `json:",omitempty" toml:",omitempty"` // Named variants of the config, ie "beta"
+}
+
+// RewriteRule describes how references to a generated asset are rewritten
+// inside the pages that use them.  Rules are checked in order; the first
+// rule whose Match pattern (see path.Match) fits the referenced path wins.
+type RewriteRule struct {
+	Match       string // ie "/index.js" or "/images/*.png"
+	Compressed  bool   // In the .gz variant of a page, reference the .gz asset
+	Fingerprint bool   // Reference the content-hashed asset name
+	Prefix      string // Prepended to the reference, ie "https://cdn.example.com"
+}
+
+// CrowdinConfig describes the Crowdin project translations are synced with.
+// The API token is kept out of the config file (and the repo): it is read
+// from the environment variable TokenEnv, or else from TokenFile.
+// If ProjectID is not set, crowdin.json is used instead.
+type CrowdinConfig struct {
+	ProjectID      int
+	TokenEnv       string // ie "CROWDIN_TOKEN"
+	TokenFile      string // ie "/etc/fsbuilder/crowdin.token"
+	APIURL         string // For Crowdin Enterprise; "" for crowdin.com
+	Proxy          string // ie "http://proxy.example.com:3128"
+	ConnectTimeout int    // Seconds; 0 for the library default
+	Timeout        int    // Seconds, for each read or write; 0 for the library default
+	Debug          bool   // Log every API call to stderr
 }
 
 // Defaults will update a config record with safe defaults for any missing values
@@ -48,18 +98,6 @@ func (r *Record) Defaults() {
 		r.Directories.OutputDir = "output"
 	}
 
-	if len(r.Processors.Note) == 0 {
-		r.Processors.Note = []string{
-			"Macros available:",
-			"[NAME] will simply be index.html.en_US, index.js.en_US, or comment.php",
-			"[NAMEGZ] will simply be index.html.gz.en_US, index.js.gz.en_US, or comment.php.gz",
-			"For convenience:",
-			"[INPUT] will be identical to [NAME].orig - and is written to disk at the start of the commands.",
-			"[OUTPUT] will be idetnical to [NAME]",
-			"All processors must be defined.  At minimum simply use mv [NAME].orig NAME",
-		}
-	}
-
 	if len(r.Processors.JS) == 0 {
 		r.Processors.JS = []string{
 			//			`uglifyjs2  [NAME].orig -o [NAME] -c --warnings=false   --source-map [NAME].map   --stats`,
@@ -101,27 +139,73 @@ func (r *Record) Defaults() {
 		r.Map["images-nc.htaccess"] = "images-nc/.htaccess"
 	}
 
-}
+	if r.Options.Env == nil {
+		r.Options.Env = []string{}
+	}
 
-// Load a config file, return it after adjusting for defaults
-func Load(filename string) (*Record, error) {
-	r := &Record{}
+	if r.Vars == nil {
+		r.Vars = make(map[string]string)
+	}
+
+	if r.Crowdin.TokenEnv == "" {
+		r.Crowdin.TokenEnv = "CROWDIN_TOKEN"
+	}
+
+	if r.Sitemap.Robots == nil {
+		r.Sitemap.Robots = []string{
+			"User-agent: *",
+			"Disallow:",
+		}
+	}
 
-	// If a filename is specified, load it.
-	if filename != "" {
-		b, e := ioutil.ReadFile(filename)
-		if e != nil {
-			return r, e
+	if r.Rewrite == nil {
+		r.Rewrite = []RewriteRule{
+			{Match: "/index.js", Compressed: true},
+			{Match: "/index.css", Compressed: true},
 		}
-		e = json.Unmarshal(b, r)
-		if e != nil {
-			return r, e
+	}
+
+}
+
+// Load a config file, return it after adjusting for defaults.
+// The file may be JSON, YAML or TOML (by extension), and may extend other
+// config files.  The environment (see EnvPrefix) and overrides (ie
+// "Options.MaxThreads=8") are applied on top.  Unknown fields are an
+// error (see Check); except in the environment, where they are logged.
+func Load(filename string, overrides ...string) (*Record, error) {
+	r := &Record{}
+	s, e := read(filename, overrides)
+	if e != nil {
+		return r, e
+	}
+	problems := decode(s, r)
+	if Failed(problems) {
+		msgs := []string{}
+		for _, p := range problems {
+			msgs = append(msgs, p.String())
 		}
+		return r, fmt.Errorf("%s: %s", filename, strings.Join(msgs, "; "))
+	}
+	for _, p := range problems {
+		log.Printf("%s: %s", filename, p)
 	}
 	r.Defaults()
 	return r, nil
 }
 
+// Check loads a config file like Load, and validates it (see Validate);
+// returning every problem found, rather than stopping at the first.
+func Check(filename string, overrides ...string) (*Record, []Problem) {
+	r := &Record{}
+	s, e := read(filename, overrides)
+	if e != nil {
+		return r, []Problem{{Message: e.Error()}}
+	}
+	problems := decode(s, r)
+	r.Defaults()
+	return r, append(problems, r.Validate()...)
+}
+
 func (r *Record) String() string {
 	b, e := json.MarshalIndent(r, "", "\t")
 	if e != nil {
@@ -141,3 +225,11 @@ func Example() string {
 	r.Defaults()
 	return r.String()
 }
+
+// ExampleFormat returns a sample config with defaults, in a format; one
+// of Formats.
+func ExampleFormat(format string) (string, error) {
+	r := &Record{}
+	r.Defaults()
+	return r.Format(format)
+}
@@ -0,0 +1,212 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadStrict(t *testing.T) {
+	fn := t.TempDir() + "/conf.json"
+	ioutil.WriteFile(fn, []byte(`{
+		"Directories": {"templatedir": "t", "OutputDri": "out"},
+		"Rewrite": [{"Match": "/index.js", "Fingerprnt": true}],
+		"Options": {"MaxThreads": "four"}
+	}`), 0644)
+	_, err := Load(fn)
+	if err == nil {
+		t.Fatal("Load of unknown fields should fail")
+	}
+	for _, want := range []string{
+		"Directories.OutputDri: unknown field (did you mean OutputDir?)",
+		"Rewrite[0].Fingerprnt: unknown field (did you mean Fingerprint?)",
+		"Options.MaxThreads: line 4: expected int, not string",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Load error is missing %q: %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "templatedir") {
+		t.Errorf("field names are not case sensitive: %v", err)
+	}
+
+	ioutil.WriteFile(fn, []byte(Example()), 0644)
+	if _, err = Load(fn); err != nil {
+		t.Errorf("Load of the example config: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(dir+"/templates/html", 0755)
+	os.MkdirAll(dir+"/images", 0755)
+	os.MkdirAll(dir+"/translations", 0755)
+	ioutil.WriteFile(dir+"/templates/html/index.html", nil, 0644)
+	ioutil.WriteFile(dir+"/translations/falling-sky.pot", nil, 0644)
+
+	r := &Record{}
+	r.Directories.TemplateDir = dir + "/templates"
+	r.Directories.ImagesDir = dir + "/images"
+	r.Directories.PoDir = dir + "/translations"
+	r.Directories.OutputDir = dir + "/output"
+	r.Map = map[string]string{"index.html": "index.html"}
+	r.Defaults()
+	if problems := r.Validate(); len(problems) > 0 {
+		t.Errorf("Validate=%v, expected nothing", problems)
+	}
+
+	r.Directories.OutputDir = dir
+	r.Directories.ImagesDir = dir + "/missing"
+	r.Processors.CSS = []string{"no-such-command-fsbuilder [INPUT] > [OUTPUT]", "sh -c true [FOO]"}
+	r.Map["dot.htaccess"] = "/etc/.htaccess"
+	r.Rewrite = []RewriteRule{{Match: "[x"}}
+	r.Options.MinTranslated = -1
+
+	got := []string{}
+	for _, p := range r.Validate() {
+		got = append(got, p.Field)
+	}
+	expected := "Directories.ImagesDir Directories.OutputDir Directories.OutputDir Directories.OutputDir " +
+		"Processors.CSS[0] Processors.CSS[1] Map.dot.htaccess Map.dot.htaccess Rewrite[0].Match Options.MinTranslated"
+	if strings.Join(got, " ") != expected {
+		t.Errorf("Validate=%v\nexpected %v", got, expected)
+	}
+	if !Failed(r.Validate()) {
+		t.Errorf("Failed=false, expected true")
+	}
+}
+
+func TestFormats(t *testing.T) {
+	dir := t.TempDir()
+	expected := &Record{}
+	expected.Defaults()
+	for _, format := range Formats {
+		example, err := ExampleFormat(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn := dir + "/conf." + format
+		ioutil.WriteFile(fn, []byte(example), 0644)
+		r, err := Load(fn)
+		if err != nil {
+			t.Errorf("%s: %v", format, err)
+		} else if !reflect.DeepEqual(r, expected) {
+			t.Errorf("%s: loaded %v\nexpected %v", format, r, expected)
+		}
+	}
+}
+
+func TestLayers(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(dir+"/base", 0755)
+	ioutil.WriteFile(dir+"/base/common.yaml", []byte(`
+directories:
+  templatedir: templates
+  outputdir: output
+options:
+  maxthreads: 4
+  env: [HOME]
+`), 0644)
+	ioutil.WriteFile(dir+"/beta.toml", []byte(`
+Extends = "base/common.yaml"
+[Directories]
+OutputDir = "output-beta"
+`), 0644)
+	ioutil.WriteFile(dir+"/loop.json", []byte(`{"Extends": ["beta.toml", "loop.json"]}`), 0644)
+
+	os.Setenv("FSBUILDER_SITEMAP_BASEURL", "https://beta.example.com")
+	defer os.Unsetenv("FSBUILDER_SITEMAP_BASEURL")
+	r, err := Load(dir+"/beta.toml", "Options.Env=HOME,USER", "Map.dot.htaccess=.htaccess-beta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{
+		r.Directories.TemplateDir,
+		r.Directories.OutputDir,
+		strings.Join(r.Options.Env, ","),
+		r.Sitemap.BaseURL,
+		r.Map["dot.htaccess"],
+	}
+	expected := "templates output-beta HOME,USER https://beta.example.com .htaccess-beta"
+	if strings.Join(got, " ") != expected || r.Options.MaxThreads != 4 {
+		t.Errorf("Load=%v (MaxThreads %d), expected %v (MaxThreads 4)", got, r.Options.MaxThreads, expected)
+	}
+
+	// A type error names the file it came from.
+	ioutil.WriteFile(dir+"/base/threads.json", []byte("{\n\"Options\": {\"MaxThreads\": \"four\"}\n}"), 0644)
+	ioutil.WriteFile(dir+"/threads.json", []byte(`{"Extends": "base/threads.json"}`), 0644)
+	if _, err = Load(dir + "/threads.json"); err == nil || !strings.Contains(err.Error(), "Options.MaxThreads: "+dir+"/base/threads.json line 2: expected int") {
+		t.Errorf("Load of a bad base: %v", err)
+	}
+
+	// Stray environment variables are only a warning.
+	os.Setenv("FSBUILDER_NOSUCH", "1")
+	defer os.Unsetenv("FSBUILDER_NOSUCH")
+	if _, err = Load(dir + "/beta.toml"); err != nil {
+		t.Errorf("Load with $FSBUILDER_NOSUCH: %v", err)
+	}
+	if _, problems := Check(dir + "/beta.toml"); len(problems) == 0 || !problems[0].Warning || !strings.Contains(problems[0].Message, "NOSUCH: unknown field") {
+		t.Errorf("Check with $FSBUILDER_NOSUCH: %v", problems)
+	}
+
+	if _, err = Load(dir + "/loop.json"); err == nil || !strings.Contains(err.Error(), "extends itself") {
+		t.Errorf("Load of a loop: %v", err)
+	}
+	if _, err = Load(dir+"/beta.toml", "Options.MaxThreds=8"); err == nil || !strings.Contains(err.Error(), "did you mean MaxThreads?") {
+		t.Errorf("Load with a bad -set: %v", err)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	fn := t.TempDir() + "/conf.yaml"
+	ioutil.WriteFile(fn, []byte(`
+Sitemap:
+  BaseURL: https://test-ipv6.com
+Vars:
+  analytics: ga-prod
+  banner: ""
+Profiles:
+  beta:
+    Sitemap:
+      BaseURL: https://beta.test-ipv6.com
+    Vars:
+      banner: beta
+    Options:
+      Locales: [fr_FR]
+  mirror:
+    Sitemap:
+      BaseURL: https://mirror.example.com
+`), 0644)
+
+	r, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Profile != "" || r.Sitemap.BaseURL != "https://test-ipv6.com" || len(r.Profiles) != 2 {
+		t.Errorf("without a profile: %q %q %d", r.Profile, r.Sitemap.BaseURL, len(r.Profiles))
+	}
+
+	r, err = Load(fn, "Profile=beta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join([]string{r.Profile, r.Sitemap.BaseURL, r.Vars["analytics"], r.Vars["banner"], strings.Join(r.Options.Locales, ",")}, " ")
+	if expected := "beta https://beta.test-ipv6.com ga-prod beta fr_FR"; got != expected {
+		t.Errorf("beta: %q, expected %q", got, expected)
+	}
+
+	// Overrides still win over the profile.
+	r, err = Load(fn, "Profile=mirror", "Sitemap.BaseURL=https://other.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Sitemap.BaseURL != "https://other.example.com" {
+		t.Errorf("mirror with -set: %q", r.Sitemap.BaseURL)
+	}
+
+	if _, err = Load(fn, "Profile=bta"); err == nil || !strings.Contains(err.Error(), "did you mean beta?") {
+		t.Errorf("Load of a missing profile: %v", err)
+	}
+}
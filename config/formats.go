@@ -0,0 +1,93 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats config files can be written in, by extension; anything else
+// is read as JSON.
+var Formats = []string{"json", "yaml", "toml"}
+
+// format returns the format of a config file, by its extension.
+func format(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "json"
+}
+
+// parse decodes a config file of any format into plain values; maps,
+// lists, strings, numbers and booleans, as JSON would.
+func parse(b []byte, format string) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	var err error
+	switch format {
+	case "yaml":
+		err = yaml.Unmarshal(b, &m)
+	case "toml":
+		err = toml.Unmarshal(b, &m)
+	default:
+		err = json.Unmarshal(b, &m)
+		if se, ok := err.(*json.SyntaxError); ok {
+			err = fmt.Errorf("line %d: %w", line(b, se.Offset), se)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Round trip through JSON, so that numbers and dates look the same
+	// whatever the format.
+	if format != "json" {
+		j, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		m = make(map[string]interface{})
+		if err = json.Unmarshal(j, &m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// blockStyle makes a YAML document (decoded from JSON) use the usual
+// indented style, with strings only quoted where needed.
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
+
+// Format returns the config in a format; one of Formats.
+func (r *Record) Format(format string) (string, error) {
+	switch format {
+	case "json":
+		return r.String(), nil
+	case "yaml":
+		// Via JSON, to keep the field names and order.
+		var n yaml.Node
+		if err := yaml.Unmarshal([]byte(r.String()), &n); err != nil {
+			return "", err
+		}
+		blockStyle(&n)
+		b, err := yaml.Marshal(&n)
+		return string(b), err
+	case "toml":
+		b := &bytes.Buffer{}
+		err := toml.NewEncoder(b).Encode(r)
+		return b.String(), err
+	}
+	return "", fmt.Errorf("unknown format %q (expected %s)", format, strings.Join(Formats, ", "))
+}
@@ -0,0 +1,352 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the name of environment variables that override the
+// config; ie FSBUILDER_OPTIONS_MAXTHREADS=8 for Options.MaxThreads.
+const EnvPrefix = "FSBUILDER_"
+
+// source is a config as read (see read): the merged values, the files
+// they came from (in the order they were laid over each other), and any
+// warnings about the environment.
+type source struct {
+	Values   map[string]interface{}
+	Files    []string
+	Warnings []string
+}
+
+// unknownFieldError is returned by set for a path that names no field.
+type unknownFieldError struct {
+	msg string
+}
+
+func (e *unknownFieldError) Error() string {
+	return e.msg
+}
+
+// field finds the field of struct type t a config key refers to;
+// without regard to case, as json.Unmarshal does.
+func field(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath == "" && strings.EqualFold(fieldName(f), key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// fieldNames returns the config keys of struct type t.
+func fieldNames(t reflect.Type) []string {
+	names := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.PkgPath == "" {
+			names = append(names, fieldName(f))
+		}
+	}
+	return names
+}
+
+// canonical renames the keys of v (as read by parse) to the names of the
+// fields of t they refer to, so that layers written in different case
+// still merge.  Unknown keys are left alone, for unknownFields to find.
+func canonical(v interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		ret := make(map[string]interface{})
+		for k, item := range m {
+			if f, ok := field(t, k); ok {
+				ret[fieldName(f)] = canonical(item, f.Type)
+			} else {
+				ret[k] = item
+			}
+		}
+		return ret
+	case reflect.Slice, reflect.Array:
+		if list, ok := v.([]interface{}); ok {
+			for i := range list {
+				list[i] = canonical(list[i], t.Elem())
+			}
+		}
+	case reflect.Map:
+		if m, ok := v.(map[string]interface{}); ok {
+			for k := range m {
+				m[k] = canonical(m[k], t.Elem())
+			}
+		}
+	}
+	return v
+}
+
+// merge lays over on top of base: maps are merged, key by key; anything
+// else (including lists) in over replaces what is in base.
+func merge(base map[string]interface{}, over map[string]interface{}) map[string]interface{} {
+	ret := make(map[string]interface{})
+	for k, v := range base {
+		ret[k] = v
+	}
+	for k, v := range over {
+		b, bok := ret[k].(map[string]interface{})
+		o, ook := v.(map[string]interface{})
+		if bok && ook {
+			ret[k] = merge(b, o)
+		} else {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// extends removes the "Extends" key from a config file, returning the
+// files it names, relative to the directory of filename.
+func extends(m map[string]interface{}, filename string) ([]string, error) {
+	var names []string
+	for k, v := range m {
+		if !strings.EqualFold(k, "Extends") {
+			continue
+		}
+		delete(m, k)
+		switch v := v.(type) {
+		case string:
+			names = append(names, v)
+		case []interface{}:
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: Extends: expected file names", filename)
+				}
+				names = append(names, s)
+			}
+		default:
+			return nil, fmt.Errorf("%s: Extends: expected a file name, or a list of them", filename)
+		}
+	}
+	for i, name := range names {
+		if !filepath.IsAbs(name) {
+			names[i] = filepath.Join(filepath.Dir(filename), name)
+		}
+	}
+	return names, nil
+}
+
+// layers reads filename, on top of every file it extends (in order, and
+// recursively).  chain is the files being read, to catch loops.  Also
+// returns the files read, in the order they were laid over each other.
+func layers(filename string, chain []string) (map[string]interface{}, []string, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, c := range chain {
+		if c == abs {
+			return nil, nil, fmt.Errorf("%s: extends itself (via %s)", filename, strings.Join(chain, ", "))
+		}
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := parse(b, format(filename))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	bases, err := extends(m, filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	ret := make(map[string]interface{})
+	files := []string{}
+	for _, base := range bases {
+		bm, bfiles, err := layers(base, append(chain, abs))
+		if err != nil {
+			return nil, nil, err
+		}
+		ret = merge(ret, bm)
+		files = append(files, bfiles...)
+	}
+	return merge(ret, canonical(m, reflect.TypeOf(Record{})).(map[string]interface{})), append(files, filename), nil
+}
+
+// parseValue converts a string (from the environment, or -set) to a
+// value for a field of type t.  Lists and structs are given as JSON;
+// lists of strings may also be given comma separated.
+func parseValue(s string, t reflect.Type) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return s, nil
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		return strconv.Atoi(s)
+	case reflect.Bool:
+		return strconv.ParseBool(s)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(s), "[") {
+			list := []interface{}{}
+			for _, item := range strings.Split(s, ",") {
+				list = append(list, strings.TrimSpace(item))
+			}
+			return list, nil
+		}
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil, fmt.Errorf("expected JSON: %w", err)
+	}
+	return canonical(v, t), nil
+}
+
+// set overrides a single field in m (as read by parse), by its path; ie
+// "Options.MaxThreads" or "Map.dot.htaccess".  t is the type of m.
+func set(m map[string]interface{}, t reflect.Type, path []string, value string) error {
+	if t.Kind() == reflect.Map {
+		v, err := parseValue(value, t.Elem())
+		if err != nil {
+			return err
+		}
+		m[strings.Join(path, ".")] = v
+		return nil
+	}
+	if t.Kind() != reflect.Struct {
+		return fmt.Errorf("%s: can only be set as a whole", path[0])
+	}
+	f, ok := field(t, path[0])
+	if !ok {
+		msg := fmt.Sprintf("%s: unknown field", path[0])
+		if s := suggest(path[0], fieldNames(t)); s != "" {
+			msg += fmt.Sprintf(" (did you mean %s?)", s)
+		}
+		return &unknownFieldError{msg}
+	}
+	name := fieldName(f)
+	if len(path) == 1 {
+		v, err := parseValue(value, f.Type)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		m[name] = v
+		return nil
+	}
+	sub, ok := m[name].(map[string]interface{})
+	if !ok {
+		sub = make(map[string]interface{})
+		m[name] = sub
+	}
+	if err := set(sub, f.Type, path[1:], value); err != nil {
+		return fmt.Errorf("%s.%w", name, err)
+	}
+	return nil
+}
+
+// clone makes a deep copy of a config (see read).
+func clone(m map[string]interface{}) map[string]interface{} {
+	ret := make(map[string]interface{})
+	b, err := json.Marshal(m)
+	if err == nil {
+		err = json.Unmarshal(b, &ret)
+	}
+	if err != nil {
+		panic(err) // Plain values always round trip
+	}
+	return ret
+}
+
+// override applies the environment (see EnvPrefix) and overrides
+// ("Field.Name=value") to m, in that order.  Environment variables that
+// name no field are not an error (the environment is shared with other
+// programs); they are returned as warnings, and ignored.
+func override(m map[string]interface{}, overrides []string) ([]string, error) {
+	warnings := []string{}
+
+	// FSBUILDER_OPTIONS_MAXTHREADS=8: every "_" separates fields.
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		path := strings.Split(strings.TrimPrefix(parts[0], EnvPrefix), "_")
+		if err := set(m, reflect.TypeOf(Record{}), path, parts[1]); err != nil {
+			var unknown *unknownFieldError
+			if errors.As(err, &unknown) {
+				warnings = append(warnings, fmt.Sprintf("$%s: %v; ignored", parts[0], err))
+				continue
+			}
+			return nil, fmt.Errorf("$%s: %w", parts[0], err)
+		}
+	}
+
+	// Options.MaxThreads=8
+	for _, o := range overrides {
+		parts := strings.SplitN(o, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q: expected Field.Name=value", o)
+		}
+		if err := set(m, reflect.TypeOf(Record{}), strings.Split(parts[0], "."), parts[1]); err != nil {
+			return nil, fmt.Errorf("%s: %w", o, err)
+		}
+	}
+	return warnings, nil
+}
+
+// read loads a config file (and whatever it extends).  If a Profile is
+// selected, that profile is laid over it; and then the environment
+// (see EnvPrefix) and overrides ("Field.Name=value") on top.
+func read(filename string, overrides []string) (*source, error) {
+	m := make(map[string]interface{})
+	files := []string{}
+	if filename != "" {
+		var err error
+		if m, files, err = layers(filename, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	// The profile may be picked by any layer, including the overrides.
+	picked := clone(m)
+	warnings, err := override(picked, overrides)
+	if err != nil {
+		return nil, err
+	}
+	name, _ := picked["Profile"].(string)
+	if name == "" {
+		return &source{Values: picked, Files: files, Warnings: warnings}, nil
+	}
+
+	profiles, _ := m["Profiles"].(map[string]interface{})
+	profile, ok := profiles[name].(map[string]interface{})
+	if !ok {
+		names := []string{}
+		for n := range profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		msg := fmt.Sprintf("Profile: no profile named %q", name)
+		if s := suggest(name, names); s != "" {
+			msg += fmt.Sprintf(" (did you mean %s?)", s)
+		} else if len(names) > 0 {
+			msg += fmt.Sprintf(" (expected one of %s)", strings.Join(names, ", "))
+		}
+		return nil, fmt.Errorf("%s", msg)
+	}
+	m = merge(m, clone(profile))
+	if _, err = override(m, overrides); err != nil {
+		return nil, err
+	}
+	return &source{Values: m, Files: files, Warnings: warnings}, nil
+}
@@ -0,0 +1,208 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// fieldName is the name a struct field has in a config file.
+func fieldName(f reflect.StructField) string {
+	if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag != "" && tag != "-" {
+		return tag
+	}
+	return f.Name
+}
+
+// distance is the edit distance between two (lowercased) names.
+func distance(a string, b string) int {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// suggest returns the closest of names to name, or "" if none is close.
+func suggest(name string, names []string) string {
+	best, bestDistance := "", len(name)/3+2
+	for _, n := range names {
+		if d := distance(name, n); d < bestDistance {
+			best, bestDistance = n, d
+		}
+	}
+	return best
+}
+
+// unknownFields returns a Problem for every key of v (decoded JSON) that
+// t has no field for; matched without regard to case, as json.Unmarshal
+// does.
+func unknownFields(path string, v interface{}, t reflect.Type) []Problem {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	problems := []Problem{}
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return problems
+		}
+		keys := []string{}
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			names := []string{}
+			found := false
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				if f.PkgPath != "" {
+					continue // unexported
+				}
+				names = append(names, fieldName(f))
+				if strings.EqualFold(fieldName(f), k) {
+					problems = append(problems, unknownFields(path+fieldName(f)+".", m[k], f.Type)...)
+					found = true
+					break
+				}
+			}
+			if !found {
+				msg := "unknown field"
+				if s := suggest(k, names); s != "" {
+					msg += fmt.Sprintf(" (did you mean %s?)", s)
+				}
+				problems = append(problems, Problem{Field: path + k, Message: msg})
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if list, ok := v.([]interface{}); ok {
+			for i, item := range list {
+				problems = append(problems, unknownFields(fmt.Sprintf("%s[%d].", strings.TrimSuffix(path, "."), i), item, t.Elem())...)
+			}
+		}
+	case reflect.Map:
+		if m, ok := v.(map[string]interface{}); ok {
+			for k, item := range m {
+				problems = append(problems, unknownFields(path+k+".", item, t.Elem())...)
+			}
+		}
+	}
+	return problems
+}
+
+// line returns the line number of a byte offset into b.
+func line(b []byte, offset int64) int {
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	return strings.Count(string(b[:offset]), "\n") + 1
+}
+
+// sets reports whether v (as read by parse) has a value at path; in any
+// element, for lists.  Names are matched without regard to case.
+func sets(v interface{}, path []string) bool {
+	if len(path) == 0 {
+		return true
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if strings.EqualFold(k, path[0]) && sets(item, path[1:]) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if sets(item, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// where finds the file that gave field (ie "Options.MaxThreads") the
+// value of the wrong type; the last of files (in the order they were
+// laid over each other) to set it.  For JSON files, the line is found
+// too.  Returns "" if no file set it.
+func where(files []string, field string) (string, int) {
+	for i := len(files) - 1; i >= 0; i-- {
+		b, err := ioutil.ReadFile(files[i])
+		if err != nil {
+			continue
+		}
+		m, err := parse(b, format(files[i]))
+		if err != nil || !sets(m, strings.Split(field, ".")) {
+			continue
+		}
+		if format(files[i]) == "json" {
+			err = json.Unmarshal(b, &Record{})
+			if te, ok := err.(*json.UnmarshalTypeError); ok && te.Field == field {
+				return files[i], line(b, te.Offset)
+			}
+		}
+		return files[i], 0
+	}
+	return "", 0
+}
+
+// decode reads a config (see read) into r; every key must be known.
+// Returns every problem found, not just the first.  Type errors say
+// where the value came from: the line, for the file being loaded (the
+// last of s.Files); the file name (and line), for a file it extends.
+// Warnings about the environment come first.
+func decode(s *source, r *Record) []Problem {
+	problems := []Problem{}
+	for _, w := range s.Warnings {
+		problems = append(problems, Problem{Message: w, Warning: true})
+	}
+	problems = append(problems, unknownFields("", s.Values, reflect.TypeOf(r))...)
+
+	b, err := json.Marshal(s.Values)
+	if err != nil {
+		return append(problems, Problem{Message: err.Error()})
+	}
+	if err := json.Unmarshal(b, r); err != nil {
+		if te, ok := err.(*json.UnmarshalTypeError); ok {
+			at := ""
+			fn, n := where(s.Files, te.Field)
+			switch {
+			case fn != "" && fn != s.Files[len(s.Files)-1]:
+				at = fn + ": "
+				if n > 0 {
+					at = fmt.Sprintf("%s line %d: ", fn, n)
+				}
+			case n > 0:
+				at = fmt.Sprintf("line %d: ", n)
+			}
+			problems = append(problems, Problem{Field: te.Field, Message: fmt.Sprintf("%sexpected %s, not %s", at, te.Type, te.Value)})
+		} else {
+			problems = append(problems, Problem{Message: err.Error()})
+		}
+	}
+	return problems
+}
@@ -0,0 +1,228 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Problem is something wrong with a config file.
+type Problem struct {
+	Field   string // ie "Directories.PoDir"; "" for the file as a whole
+	Message string
+	Warning bool // Suspicious, but the build can go ahead
+}
+
+func (p Problem) String() string {
+	s := p.Message
+	if p.Warning {
+		s = "warning: " + s
+	}
+	if p.Field != "" {
+		s = p.Field + ": " + s
+	}
+	return s
+}
+
+// Failed reports whether any of problems is an error.
+func Failed(problems []Problem) bool {
+	for _, p := range problems {
+		if !p.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// Macros that processors may use; see the Processors field of Record.
+var reMACRO = regexp.MustCompile(`\[([A-Z]+)\]`)
+var macros = map[string]bool{"NAME": true, "NAMEGZ": true, "INPUT": true, "OUTPUT": true}
+
+// reCOMMAND is a command name worth looking for in $PATH; anything
+// fancier (variables, quoting, subshells) is left to the shell.
+var reCOMMAND = regexp.MustCompile(`^[A-Za-z0-9_.+/-]+$`)
+
+var shellBuiltins = map[string]bool{
+	"cd": true, "set": true, "export": true, "exit": true, "test": true, "[": true,
+	"true": true, "false": true, "echo": true, "if": true, "for": true, "while": true,
+}
+
+// checkDir reports a problem if dir is not a directory.
+func checkDir(field string, dir string) []Problem {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return []Problem{{Field: field, Message: err.Error()}}
+	}
+	if !st.IsDir() {
+		return []Problem{{Field: field, Message: dir + ": not a directory"}}
+	}
+	return nil
+}
+
+// inside reports whether dir is, or is inside, parent.
+func inside(dir string, parent string) bool {
+	a, err1 := filepath.Abs(dir)
+	b, err2 := filepath.Abs(parent)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return a == b || strings.HasPrefix(a, b+string(filepath.Separator))
+}
+
+// templates returns the names of every template, in every subdirectory of
+// the template directory.
+func templates(dir string) map[string]bool {
+	ret := make(map[string]bool)
+	subdirs, _ := ioutil.ReadDir(dir)
+	for _, sub := range subdirs {
+		if !sub.IsDir() {
+			continue
+		}
+		files, _ := ioutil.ReadDir(dir + "/" + sub.Name())
+		for _, f := range files {
+			ret[f.Name()] = true
+		}
+	}
+	return ret
+}
+
+// Validate checks a loaded (and defaulted) config for problems that would
+// otherwise only be found part way through a build: missing directories,
+// processors that are not installed, bad Map targets and the like.
+func (r *Record) Validate() []Problem {
+	problems := []Problem{}
+	add := func(field string, warning bool, format string, args ...interface{}) {
+		problems = append(problems, Problem{Field: field, Message: fmt.Sprintf(format, args...), Warning: warning})
+	}
+
+	// Directories
+	d := r.Directories
+	problems = append(problems, checkDir("Directories.TemplateDir", d.TemplateDir)...)
+	problems = append(problems, checkDir("Directories.ImagesDir", d.ImagesDir)...)
+	problems = append(problems, checkDir("Directories.PoDir", d.PoDir)...)
+	if _, err := os.Stat(d.PoDir + "/falling-sky.pot"); err != nil {
+		add("Directories.PoDir", false, "%s", err)
+	}
+	for _, dir := range []struct{ field, dir string }{
+		{"Directories.TemplateDir", d.TemplateDir},
+		{"Directories.ImagesDir", d.ImagesDir},
+		{"Directories.PoDir", d.PoDir},
+	} {
+		if inside(dir.dir, d.OutputDir) {
+			add("Directories.OutputDir", false, "%s contains %s (%s), and is removed by every build", d.OutputDir, dir.field, dir.dir)
+		}
+	}
+
+	// Processors
+	if len(r.Processors.Note) > 0 {
+		add("Processors.Note", true, "ignored; see the README for the macros processors can use")
+	}
+	for _, p := range []struct {
+		field    string
+		commands []string
+	}{
+		{"Processors.JS", r.Processors.JS},
+		{"Processors.CSS", r.Processors.CSS},
+		{"Processors.HTML", r.Processors.HTML},
+		{"Processors.PHP", r.Processors.PHP},
+		{"Processors.Apache", r.Processors.Apache},
+	} {
+		for i, command := range p.commands {
+			field := fmt.Sprintf("%s[%d]", p.field, i)
+			for _, m := range reMACRO.FindAllStringSubmatch(command, -1) {
+				if !macros[m[1]] {
+					add(field, true, "unknown macro %s (expected [NAME], [NAMEGZ], [INPUT] or [OUTPUT])", m[0])
+				}
+			}
+			words := strings.Fields(command)
+			if len(words) == 0 {
+				add(field, false, "empty command")
+				continue
+			}
+			if !reCOMMAND.MatchString(words[0]) || shellBuiltins[words[0]] {
+				continue
+			}
+			if _, err := exec.LookPath(words[0]); err != nil {
+				add(field, false, "%s: not found in $PATH", words[0])
+			}
+		}
+	}
+
+	// Map
+	known := templates(d.TemplateDir)
+	targets := make(map[string]string)
+	froms := []string{}
+	for from := range r.Map {
+		froms = append(froms, from)
+	}
+	sort.Strings(froms)
+	for _, from := range froms {
+		to := r.Map[from]
+		field := "Map." + from
+		switch {
+		case to == "":
+			add(field, false, "empty target")
+		case path.IsAbs(to) || path.Clean(to) == ".." || strings.HasPrefix(path.Clean(to), "../"):
+			add(field, false, "%s: target must be inside Directories.OutputDir", to)
+		case targets[path.Clean(to)] != "":
+			add(field, false, "%s: also the target of %s", to, targets[path.Clean(to)])
+		}
+		targets[path.Clean(to)] = from
+		if len(known) > 0 && !known[from] {
+			add(field, true, "no template named %s; the mapping is unused", from)
+		}
+	}
+
+	// Rewrite
+	for i, rule := range r.Rewrite {
+		if _, err := path.Match(rule.Match, ""); err != nil {
+			add(fmt.Sprintf("Rewrite[%d].Match", i), false, "%q: %s", rule.Match, err)
+		}
+	}
+
+	// Sitemap
+	if r.Sitemap.BaseURL != "" {
+		u, err := url.Parse(r.Sitemap.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("Sitemap.BaseURL", false, "%q: expected a URL like https://test-ipv6.com", r.Sitemap.BaseURL)
+		}
+	}
+
+	// Options
+	if r.Options.MaxThreads < 0 {
+		add("Options.MaxThreads", false, "must not be negative")
+	}
+	if r.Options.MinTranslated < 0 || r.Options.MinTranslated > 100 {
+		add("Options.MinTranslated", false, "%d: expected a percentage, 0 to 100", r.Options.MinTranslated)
+	}
+	if r.Options.MinApproved < 0 || r.Options.MinApproved > 100 {
+		add("Options.MinApproved", false, "%d: expected a percentage, 0 to 100", r.Options.MinApproved)
+	}
+
+	// Crowdin; only needed for the Crowdin commands, so just warnings.
+	if r.Crowdin.TokenFile != "" {
+		if _, err := os.Stat(r.Crowdin.TokenFile); err != nil {
+			add("Crowdin.TokenFile", true, "%s", err)
+		}
+	}
+	for _, u := range []struct{ field, url string }{
+		{"Crowdin.APIURL", r.Crowdin.APIURL},
+		{"Crowdin.Proxy", r.Crowdin.Proxy},
+	} {
+		if u.url == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u.url); err != nil || parsed.Host == "" {
+			add(u.field, true, "%q: expected a URL", u.url)
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,193 @@
+package crowdinio
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	crowdin "github.com/fabdem/go-crowdinv2"
+)
+
+// Progress is how far along the translation of a file is, for one
+// language, in percent.
+type Progress struct {
+	Translated int
+	Approved   int            // Crowdin's approval percentage for the file
+	Steps      map[string]int `json:",omitempty"` // Approved at each review step of the workflow, by step title
+}
+
+// Approval is what MinApproved is checked against: the least approved
+// review step, for projects with a workflow (Crowdin Enterprise);
+// otherwise Crowdin's approval percentage.
+func (p Progress) Approval() int {
+	if len(p.Steps) == 0 {
+		return p.Approved
+	}
+	least := 100
+	for _, percent := range p.Steps {
+		if percent < least {
+			least = percent
+		}
+	}
+	return least
+}
+
+// step is a review step of a Crowdin workflow.
+type step struct {
+	ID        int
+	Title     string
+	Languages []string // Empty for every language
+}
+
+// stepProgress works out how much of a file (total strings) is approved
+// at each of steps, for one language; approved has the strings approved,
+// by step ID.
+func stepProgress(steps []step, approved map[int]map[int]bool, total int, language string) map[string]int {
+	ret := make(map[string]int)
+	for _, s := range steps {
+		applies := len(s.Languages) == 0
+		for _, l := range s.Languages {
+			applies = applies || l == language
+		}
+		if !applies {
+			continue
+		}
+		ret[s.Title] = 0
+		if total > 0 {
+			ret[s.Title] = 100 * len(approved[s.ID]) / total
+		}
+	}
+	return ret
+}
+
+// Client is the part of the Crowdin API that fsbuilder uses.
+// API talks to Crowdin; Fake stands in for it in tests.
+type Client interface {
+	// UploadSource replaces a source file on Crowdin (ie falling-sky.pot)
+	// with a local file, keeping translations and approvals.
+	UploadSource(name string, localFile string) (fileID int, revID int, err error)
+
+	// Build builds the translations of the project, and waits for it.
+	Build() (buildID int, err error)
+
+	// Download saves a build (or the latest build, for 0) as a zip archive.
+	Download(buildID int, fn string) error
+
+	// Progress reports the progress of a source file, by language.
+	Progress(name string) (map[string]Progress, error)
+
+	// UploadTranslation adds the translations in a local .po file to a
+	// source file on Crowdin, for one language (ie "fr" or "pt-BR").
+	UploadTranslation(name string, language string, localFile string) error
+}
+
+// API is a Client for the real Crowdin, using go-crowdinv2.
+type API struct {
+	c *crowdin.Crowdin
+}
+
+// NewAPI wraps a connection made with crowdin.New.
+func NewAPI(c *crowdin.Crowdin) *API {
+	return &API{c: c}
+}
+
+// UploadSource implements Client.
+func (a *API) UploadSource(name string, localFile string) (int, int, error) {
+	return a.c.Update(name, localFile, "keep_translations_and_approvals")
+}
+
+// Build implements Client.
+func (a *API) Build() (int, error) {
+	return a.c.BuildTranslationAllLg(crowdin.BuildTranslationAllLgOptions{
+		BuildTO:                     10 * time.Minute, // Timeout
+		TranslatedOnly:              false,
+		MinApprovalSteps:            0,
+		FullyTranslatedFilesOnly:    false,
+		ExportStringsThatPassedWkfl: false,
+		FolderName:                  "",
+	})
+}
+
+// Download implements Client.
+func (a *API) Download(buildID int, fn string) error {
+	return a.c.DownloadBuild(fn, buildID)
+}
+
+// Progress implements Client.
+func (a *API) Progress(name string) (map[string]Progress, error) {
+	fileID, _, err := a.c.LookupFileId(name)
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.c.GetFileProgress(&crowdin.GetFileProgressOptions{FileId: fileID, Limit: 500})
+	if err != nil {
+		return nil, err
+	}
+	steps := a.reviewSteps()
+	ret := make(map[string]Progress)
+	for _, v := range res.Data {
+		p := Progress{Translated: v.Data.TranslationProgress, Approved: v.Data.ApprovalProgress}
+		if len(steps) > 0 {
+			approved, err := a.approvals(fileID, v.Data.LanguageId)
+			if err != nil {
+				return nil, err
+			}
+			p.Steps = stepProgress(steps, approved, v.Data.Phrases.Total, v.Data.LanguageId)
+		}
+		ret[v.Data.LanguageId] = p
+	}
+	return ret, nil
+}
+
+// reviewSteps lists the proofreading steps of the project's workflow.
+// Only Crowdin Enterprise has workflows; elsewhere, listing them fails,
+// and there are none.
+func (a *API) reviewSteps() []step {
+	res, err := a.c.ListWorkflowsSteps(&crowdin.ListWorkflowsStepsOptions{Limit: 500})
+	if err != nil {
+		return nil
+	}
+	steps := []step{}
+	for _, v := range res.Data {
+		if strings.Contains(v.Data.Type, "Proofread") {
+			steps = append(steps, step{ID: v.Data.ID, Title: v.Data.Title, Languages: v.Data.Languages})
+		}
+	}
+	return steps
+}
+
+// approvals returns the strings of a file approved in a language, by
+// workflow step ID.
+func (a *API) approvals(fileID int, language string) (map[int]map[int]bool, error) {
+	const limit = 500
+	ret := make(map[int]map[int]bool)
+	for offset := 0; ; offset += limit {
+		res, err := a.c.ListTranslationApprovals(&crowdin.ListTranslationApprovalsOptions{FileID: fileID, LanguageID: language, Limit: limit, Offset: offset})
+		if err != nil {
+			return nil, fmt.Errorf("%s: approvals: %w", language, err)
+		}
+		for _, v := range res.Data {
+			if ret[v.Data.WorkflowStepID] == nil {
+				ret[v.Data.WorkflowStepID] = make(map[int]bool)
+			}
+			ret[v.Data.WorkflowStepID][v.Data.StringID] = true
+		}
+		if len(res.Data) < limit {
+			return ret, nil
+		}
+	}
+}
+
+// UploadTranslation implements Client.
+func (a *API) UploadTranslation(name string, language string, localFile string) error {
+	_, err := a.c.UploadTranslationFile(crowdin.T_UploadTranslationFileParams{
+		LocalFileName:       localFile,
+		CrowdinFileName:     name,
+		LanguageId:          language,
+		ImportEqSuggestions: false,
+		AutoApproveImported: false,
+		TranslateHidden:     false,
+		ResponseTimeOut:     5 * time.Minute,
+	})
+	return err
+}
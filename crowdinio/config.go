@@ -7,15 +7,15 @@ import (
 	"log"
 )
 
-// config contains configuration options
-type config struct {
+// fileConfig contains the options in crowdin.json (see config.CrowdinConfig)
+type fileConfig struct {
 	Token     string `json:"token" yaml:"token"`
 	ProjectID int    `json:"project_id" yaml:"project_id"`
 }
 
 // load a config file, return it after adjusting for defaults
-func load(filename string) (*config, error) {
-	r := &config{}
+func load(filename string) (*fileConfig, error) {
+	r := &fileConfig{}
 
 	// If a filename is specified, load it.
 
@@ -30,7 +30,7 @@ func load(filename string) (*config, error) {
 	return r, nil
 }
 
-func (r *config) String() string {
+func (r *fileConfig) String() string {
 	b, e := json.MarshalIndent(r, "", "\t")
 	if e != nil {
 		log.Fatal(e)
@@ -45,6 +45,6 @@ func (r *config) String() string {
 
 // Return a sample config with defaults
 func Example() string {
-	r := &config{}
+	r := &fileConfig{}
 	return r.String()
 }
@@ -3,75 +3,92 @@ package crowdinio
 import (
 	"errors"
 	"fmt"
-	crowdin "github.com/fabdem/go-crowdinv2"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+
+	crowdin "github.com/fabdem/go-crowdinv2"
+	"github.com/falling-sky/fsbuilder/config"
 )
 
-func DownloadAndExit(fn string) {
-	c, err := crowdinInit()
-	if err != nil {
-		log.Fatal(err)
-	}
-	buildId, err := c.BuildTranslationAllLg(crowdin.BuildTranslationAllLgOptions{
-		BuildTO:                     10 * time.Minute, // Timeout
-		TranslatedOnly:              false,
-		MinApprovalSteps:            0,
-		FullyTranslatedFilesOnly:    false,
-		ExportStringsThatPassedWkfl: false,
-		FolderName:                  "",
-	})
+// Download builds the translations on Crowdin, and saves the archive
+// as fn.  If the build fails, the latest build is downloaded instead.
+func Download(c Client, fn string) error {
+	buildId, err := c.Build()
 	if err != nil {
-		log.Printf("WARNING: c.BuildTranslationAllLg(%q): %s", fn, err)
+		log.Printf("WARNING: c.Build(): %s", err)
 		log.Printf("WARNING: will use latest build, which MAY be stale")
 		buildId = 0
 	}
 
-	if err = c.DownloadBuild(fn, buildId); err != nil {
-		log.Fatalf("c.DownloadBuild(%q): %s", fn, err)
+	if err = c.Download(buildId, fn); err != nil {
+		return fmt.Errorf("c.Download(%q): %w", fn, err)
 	}
-
-	os.Exit(0)
+	return nil
 }
 
-func UploadAndExit(fn string) {
-	c, err := crowdinInit()
+// Upload replaces the source file on Crowdin of the same name as fn
+// (which must already exist there) with fn.
+func Upload(c Client, fn string) error {
+	fileID, revID, err := c.UploadSource(filepath.Base(fn), fn)
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	fileID, revID, err := c.Update(filepath.Base(fn), fn, "keep_translations_and_approvals")
-	if err != nil {
-		log.Fatalf("c.Update(%q...): %s", fn, err)
+		return fmt.Errorf("c.UploadSource(%q...): %w", fn, err)
 	}
 	log.Printf("file ID: %d", fileID)
 	log.Printf("revision ID: %d", revID)
-	os.Exit(0)
+	return nil
 }
 
-func crowdinInit() (*crowdin.Crowdin, error) {
+// token finds the API token: in the environment, or in a file.
+func token(cc config.CrowdinConfig) (string, error) {
+	if cc.TokenEnv != "" {
+		if s := strings.TrimSpace(os.Getenv(cc.TokenEnv)); s != "" {
+			return s, nil
+		}
+	}
+	if cc.TokenFile != "" {
+		b, err := ioutil.ReadFile(cc.TokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return "", nil
+}
 
-	config, err := load("crowdin.json")
+// Connect returns a Client for the configured project.  Without a
+// ProjectID, the project (and token) are read from crowdin.json.
+func Connect(cc config.CrowdinConfig) (Client, error) {
+	tok, err := token(cc)
 	if err != nil {
-		return nil, fmt.Errorf("crowdin.json: %w", err)
+		return nil, err
 	}
-	if config == nil {
-		return nil, errors.New("config nil")
+
+	if cc.ProjectID == 0 {
+		legacy, err := load("crowdin.json")
+		if err != nil {
+			return nil, fmt.Errorf("no Crowdin.ProjectID in the config, and crowdin.json: %w", err)
+		}
+		cc.ProjectID = legacy.ProjectID
+		if tok == "" {
+			tok = legacy.Token
+		}
 	}
-	if config.Token == "" {
-		return nil, errors.New("config missing crowdin.token")
+	if tok == "" {
+		return nil, fmt.Errorf("no Crowdin token: set $%s, or Crowdin.TokenFile in the config", cc.TokenEnv)
 	}
-	if config.ProjectID == 0 {
+	if cc.ProjectID == 0 {
 		return nil, errors.New("config missing crowdin.project_id")
 	}
 
-	c, err := crowdin.New(config.Token, config.ProjectID, "", "")
+	c, err := crowdin.New(tok, cc.ProjectID, cc.APIURL, cc.Proxy)
 	if err != nil {
 		return nil, err
 	}
-
-	c.SetDebug(true, os.Stderr)
-	return c, nil
+	c.SetTimeouts(time.Duration(cc.ConnectTimeout)*time.Second, time.Duration(cc.Timeout)*time.Second)
+	c.SetDebug(cc.Debug, os.Stderr)
+	return NewAPI(c), nil
 }
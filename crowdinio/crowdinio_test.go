@@ -0,0 +1,207 @@
+package crowdinio
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/falling-sky/fsbuilder/config"
+	"github.com/falling-sky/fsbuilder/po"
+)
+
+func TestUpload(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir+"/falling-sky.pot", []byte(testPo("")), 0644)
+	ioutil.WriteFile(dir+"/other.pot", []byte(testPo("")), 0644)
+
+	c := NewFake("falling-sky.pot")
+	if err := Upload(c, dir+"/falling-sky.pot"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Revisions["falling-sky.pot"] != 2 || string(c.Sources["falling-sky.pot"]) != testPo("") {
+		t.Errorf("Upload did not replace the source: %#v", c)
+	}
+	if err := Upload(c, dir+"/other.pot"); err == nil {
+		t.Errorf("Upload of a file that is not on Crowdin should fail")
+	}
+}
+
+func TestSync(t *testing.T) {
+	dl := t.TempDir() + "/dl"
+	c := NewFake("falling-sky.pot")
+	c.Translations["fr/falling-sky.fr_FR.po"] = testPo("fr_FR", "slow", "lent")
+
+	if err := Sync(c, dl, dl+".zip"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dl + "/fr/falling-sky.fr_FR.po"); err != nil {
+		t.Errorf("Sync: %v", err)
+	}
+
+	// A failed build falls back to the latest build.
+	c.FailBuild = true
+	c.Translations["de/falling-sky.de_DE.po"] = testPo("de_DE", "slow", "langsam")
+	if err := Sync(c, dl, dl+".zip"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dl + "/de/falling-sky.de_DE.po"); err != nil {
+		t.Errorf("Sync after failed build: %v", err)
+	}
+	if c.Builds != 1 {
+		t.Errorf("Builds=%d, expected 1", c.Builds)
+	}
+
+	// A bad archive is an error, not an exit.
+	c.Translations["es/falling-sky.es_ES.po"] = "garbage"
+	if err := Sync(c, dl, dl+".zip"); err == nil {
+		t.Errorf("Sync of a bad archive should fail")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir+"/token", []byte("secret\n"), 0644)
+	os.Setenv("FSBUILDER_TEST_TOKEN", "")
+
+	cc := config.CrowdinConfig{ProjectID: 1, TokenEnv: "FSBUILDER_TEST_TOKEN", TokenFile: dir + "/token"}
+	if tok, err := token(cc); err != nil || tok != "secret" {
+		t.Errorf("token from file: %q, %v", tok, err)
+	}
+	os.Setenv("FSBUILDER_TEST_TOKEN", "fromenv")
+	if tok, err := token(cc); err != nil || tok != "fromenv" {
+		t.Errorf("token from env: %q, %v", tok, err)
+	}
+	if _, err := Connect(cc); err != nil {
+		t.Errorf("Connect: %v", err)
+	}
+
+	os.Setenv("FSBUILDER_TEST_TOKEN", "")
+	cc.TokenFile = ""
+	if _, err := Connect(cc); err == nil {
+		t.Errorf("Connect without a token should fail")
+	}
+	cc.TokenFile = dir + "/missing"
+	if _, err := Connect(cc); err == nil {
+		t.Errorf("Connect with a missing TokenFile should fail")
+	}
+}
+
+func TestUploadIfChanged(t *testing.T) {
+	dir := t.TempDir()
+	pot := dir + "/falling-sky.pot"
+	state := dir + "/.crowdin-upload.json"
+	c := NewFake("falling-sky.pot")
+
+	ioutil.WriteFile(pot, []byte(testPo("", "slow", "", "fast", "")), 0644)
+	if up, err := UploadIfChanged(c, pot, state); err != nil || !up {
+		t.Fatalf("first upload: %v, %v", up, err)
+	}
+	if up, err := UploadIfChanged(c, pot, state); err != nil || up {
+		t.Errorf("unchanged upload: %v, %v", up, err)
+	}
+
+	ioutil.WriteFile(pot, []byte(testPo("", "slow", "", "faster", "", "new", "")), 0644)
+	if up, err := UploadIfChanged(c, pot, state); err != nil || !up {
+		t.Errorf("changed upload: %v, %v", up, err)
+	}
+	if c.Revisions["falling-sky.pot"] != 3 {
+		t.Errorf("Revision=%d, expected 3", c.Revisions["falling-sky.pot"])
+	}
+
+	if added, removed := diffStrings([]string{"fast", "slow"}, []string{"faster", "new", "slow"}); added != 2 || removed != 1 {
+		t.Errorf("diffStrings=%d,%d, expected 2,1", added, removed)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(dir+"/dl/fr", 0755)
+	os.MkdirAll(dir+"/dl/pt", 0755)
+	ioutil.WriteFile(dir+"/falling-sky.pot", []byte(testPo("", "slow", "", "fast", "")), 0644)
+	ioutil.WriteFile(dir+"/dl/fr/falling-sky.po", []byte(testPo("fr_FR", "slow", "lent", "fast", "vite")), 0644)
+	ioutil.WriteFile(dir+"/dl/pt/falling-sky.po", []byte(testPo("pt_BR", "slow", "lento")), 0644)
+	files, err := po.LoadAll(dir+"/falling-sky.pot", dir+"/dl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewFake("falling-sky.pot")
+	c.Progresses["falling-sky.pot"] = map[string]Progress{
+		"fr":    {Translated: 100, Approved: 20},
+		"pt-BR": {Translated: 50, Approved: 20, Steps: map[string]int{"Proofread": 60, "Final": 50}},
+	}
+	if _, err = FetchProgress(c, "falling-sky.pot", dir+"/progress.json"); err != nil {
+		t.Fatal(err)
+	}
+	progress, err := LoadProgress(dir + "/progress.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		minTranslated, minApproved int
+		expected                   string
+	}{
+		{0, 0, "fr_FR=true pt_BR=true "},
+		{70, 0, "fr_FR=true pt_BR=false "},
+		{0, 30, "fr_FR=false pt_BR=true "},
+	} {
+		got := ""
+		for _, s := range Merge(files, progress, tc.minTranslated, tc.minApproved) {
+			if !s.OnCrowdin {
+				t.Errorf("%s: not matched to a Crowdin language", s.Locale)
+			}
+			got += fmt.Sprintf("%s=%v ", s.Locale, s.Publish)
+		}
+		if got != tc.expected {
+			t.Errorf("Merge(%d, %d)=%q, expected %q", tc.minTranslated, tc.minApproved, got, tc.expected)
+		}
+	}
+}
+
+func TestStepProgress(t *testing.T) {
+	steps := []step{{ID: 1, Title: "Proofread"}, {ID: 2, Title: "Legal", Languages: []string{"de"}}}
+	approved := map[int]map[int]bool{1: {10: true, 11: true, 12: true}, 2: {10: true}}
+	got := fmt.Sprint(stepProgress(steps, approved, 4, "fr"), stepProgress(steps, approved, 4, "de"))
+	if expected := "map[Proofread:75] map[Legal:25 Proofread:75]"; got != expected {
+		t.Errorf("stepProgress=%s, expected %s", got, expected)
+	}
+	if p := (Progress{Approved: 90, Steps: map[string]int{"Proofread": 75, "Legal": 25}}); p.Approval() != 25 {
+		t.Errorf("Approval()=%d, expected the least approved step", p.Approval())
+	}
+}
+
+func TestPush(t *testing.T) {
+	dir := t.TempDir()
+	dl := dir + "/dl"
+	c := NewFake("falling-sky.pot")
+	c.Translations["fr/falling-sky.fr_FR.po"] = testPo("fr_FR", "slow", "lent", "fast", "vite", "up", "")
+	c.Translations["de/falling-sky.de_DE.po"] = testPo("de_DE", "slow", "langsam")
+	if err := Sync(c, dl, dir+"/build.zip"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing edited yet.
+	if pushed, err := Push(c, "falling-sky.pot", dl, dir+"/build.zip"); err != nil || len(pushed) != 0 {
+		t.Fatalf("Push before edits: %v, %v", pushed, err)
+	}
+
+	// A hotfix to fr_FR: one fixed, one added.
+	ioutil.WriteFile(dl+"/fr/falling-sky.fr_FR.po", []byte(testPo("fr_FR", "slow", "lente", "fast", "vite", "up", "haut")), 0644)
+	pushed, err := Push(c, "falling-sky.pot", dl, dir+"/build.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pushed) != 1 || pushed[0].Locale != "fr_FR" || pushed[0].Added != 1 || pushed[0].Changed != 1 {
+		t.Errorf("Push=%v, expected fr_FR: 1 added, 1 changed", pushed)
+	}
+	if _, ok := c.Uploads["de-DE"]; ok {
+		t.Errorf("de_DE was not edited, and should not be pushed")
+	}
+	up := c.Uploads["fr-FR"]
+	if !strings.Contains(up, `msgstr "lente"`) || !strings.Contains(up, `msgstr "haut"`) || strings.Contains(up, "vite") {
+		t.Errorf("Push uploaded %q, expected just the edits", up)
+	}
+}
@@ -0,0 +1,144 @@
+package crowdinio
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Fake is an offline, in-process Client for tests.  Sources must exist
+// before they can be uploaded, as on Crowdin.
+type Fake struct {
+	lock sync.Mutex
+
+	Sources      map[string][]byte              // Source file content, by name
+	Revisions    map[string]int                 // Source file revision, by name
+	Translations map[string]string              // Content of the build archive, by path
+	Progresses   map[string]map[string]Progress // Progress by source name, then language
+	Uploads      map[string]string              // Translations uploaded, by language
+
+	Builds    int  // How many builds were made
+	FailBuild bool // Make Build fail, as if it timed out
+}
+
+// NewFake returns a Fake with the named (empty) source files.
+func NewFake(sources ...string) *Fake {
+	f := &Fake{
+		Sources:      make(map[string][]byte),
+		Revisions:    make(map[string]int),
+		Translations: make(map[string]string),
+		Progresses:   make(map[string]map[string]Progress),
+		Uploads:      make(map[string]string),
+	}
+	for _, name := range sources {
+		f.Sources[name] = nil
+		f.Revisions[name] = 1
+	}
+	return f
+}
+
+// fileID makes up a stable ID for a source file.
+func (f *Fake) fileID(name string) int {
+	names := []string{}
+	for n := range f.Sources {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for i, n := range names {
+		if n == name {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// UploadSource implements Client.
+func (f *Fake) UploadSource(name string, localFile string) (int, int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.Sources[name]; !ok {
+		return 0, 0, fmt.Errorf("%s: no such file on Crowdin", name)
+	}
+	b, err := ioutil.ReadFile(localFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	f.Sources[name] = b
+	f.Revisions[name]++
+	return f.fileID(name), f.Revisions[name], nil
+}
+
+// Build implements Client.
+func (f *Fake) Build() (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.FailBuild {
+		return 0, fmt.Errorf("build timed out")
+	}
+	f.Builds++
+	return f.Builds, nil
+}
+
+// Download implements Client; the archive holds Translations.
+func (f *Fake) Download(buildID int, fn string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if buildID > f.Builds {
+		return fmt.Errorf("build %d: not found", buildID)
+	}
+	out, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	w := zip.NewWriter(out)
+	names := []string{}
+	for name := range f.Translations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fw, err := w.Create(name)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		fw.Write([]byte(f.Translations[name]))
+	}
+	if err = w.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Progress implements Client.
+func (f *Fake) Progress(name string) (map[string]Progress, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.Sources[name]; !ok {
+		return nil, fmt.Errorf("%s: no such file on Crowdin", name)
+	}
+	ret := make(map[string]Progress)
+	for lang, p := range f.Progresses[name] {
+		ret[lang] = p
+	}
+	return ret, nil
+}
+
+// UploadTranslation implements Client.
+func (f *Fake) UploadTranslation(name string, language string, localFile string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.Sources[name]; !ok {
+		return fmt.Errorf("%s: no such file on Crowdin", name)
+	}
+	b, err := ioutil.ReadFile(localFile)
+	if err != nil {
+		return err
+	}
+	f.Uploads[language] = string(b)
+	return nil
+}
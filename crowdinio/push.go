@@ -0,0 +1,110 @@
+package crowdinio
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/falling-sky/fsbuilder/po"
+)
+
+// languageID is the Crowdin language of a .po file (ie "fr" or
+// "pt-BR"); Crowdin says which in the files it exports.
+func languageID(f *po.File) string {
+	if lang := f.Headers["X-Crowdin-Language"]; lang != "" {
+		return lang
+	}
+	return strings.Replace(f.Locale, "_", "-", -1)
+}
+
+// edited returns the msgids translated in after, that were not
+// translated (or were translated differently) in before.
+func edited(before *po.File, after *po.File) []string {
+	ret := []string{}
+	for _, msgid := range after.InOrder {
+		now, ok := translated(after, msgid)
+		if !ok {
+			continue
+		}
+		if was, ok := translated(before, msgid); !ok || was != now {
+			ret = append(ret, msgid)
+		}
+	}
+	return ret
+}
+
+// writeEdits writes a .po file with just the given msgids of f.
+func writeEdits(f *po.File, msgids []string, fn string) error {
+	b := &bytes.Buffer{}
+	po.PoQuote(b, "msgid", "")
+	po.PoQuote(b, "msgstr", f.ByID[""].MsgStr)
+	b.WriteString("\n")
+	for _, msgid := range msgids {
+		po.PoQuote(b, "msgid", msgid)
+		po.PoQuote(b, "msgstr", f.ByID[msgid].MsgStr)
+		b.WriteString("\n")
+	}
+	return ioutil.WriteFile(fn, b.Bytes(), 0644)
+}
+
+// Push finds translations edited in dir (ie translations/dl) since the
+// build in archive was downloaded (see Sync), and uploads just those to
+// the source file name (ie falling-sky.pot) on Crowdin, so that the next
+// download keeps them.  Returns what was pushed, by locale.
+func Push(c Client, name string, dir string, archive string) ([]LocaleChange, error) {
+	tmp, err := ioutil.TempDir("", "crowdin-push")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	if _, err = Extract(archive, tmp+"/build"); err != nil {
+		return nil, err
+	}
+	before, _, err := loadDir(tmp + "/build")
+	if err != nil {
+		return nil, err
+	}
+	after, paths, err := loadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := Compare(tmp+"/build", dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pushed := []LocaleChange{}
+	for _, change := range changes {
+		if change.Gone {
+			continue
+		}
+		if change.New {
+			log.Printf("%s: %s is not in the last download, skipped", change.Locale, paths[change.Locale])
+			continue
+		}
+		if change.Removed > 0 {
+			log.Printf("WARNING: %s: %d translations removed locally; remove them on Crowdin", change.Locale, change.Removed)
+		}
+		msgids := edited(before[change.Locale], after[change.Locale])
+		if len(msgids) == 0 {
+			continue
+		}
+		fn := tmp + "/" + change.Locale + ".po"
+		if err = writeEdits(after[change.Locale], msgids, fn); err != nil {
+			return pushed, err
+		}
+		if err = c.UploadTranslation(name, languageID(after[change.Locale]), fn); err != nil {
+			return pushed, fmt.Errorf("%s: c.UploadTranslation(%q...): %w", change.Locale, name, err)
+		}
+		log.Printf("%s: pushed %d added, %d changed", change.Locale, change.Added, change.Changed)
+		pushed = append(pushed, change)
+	}
+	if len(pushed) == 0 {
+		log.Printf("%s: no local edits to push", dir)
+	}
+	return pushed, nil
+}
@@ -0,0 +1,110 @@
+package crowdinio
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/falling-sky/fsbuilder/po"
+)
+
+// LocaleStatus is how far along a locale is, both by the local .po file
+// and by Crowdin (which also knows what has been approved).
+type LocaleStatus struct {
+	Locale     string
+	Translated int      // Strings translated in the local .po file
+	OutOf      int      // Strings in the .pot file
+	Crowdin    Progress // As reported by Crowdin
+	OnCrowdin  bool     // Crowdin reported progress for the locale
+	Publish    bool     // Meets the thresholds given to Merge
+}
+
+// Percent is the local translation progress, in percent (rounded down).
+func (s LocaleStatus) Percent() int {
+	if s.OutOf == 0 {
+		return 0
+	}
+	return 100 * s.Translated / s.OutOf
+}
+
+func (s LocaleStatus) String() string {
+	crowdin := "not on Crowdin"
+	if s.OnCrowdin {
+		crowdin = fmt.Sprintf("crowdin %d%% translated, %d%% approved", s.Crowdin.Translated, s.Crowdin.Approval())
+		if n := len(s.Crowdin.Steps); n > 0 {
+			crowdin += fmt.Sprintf(" (least of %d steps)", n)
+		}
+	}
+	publish := "publish"
+	if !s.Publish {
+		publish = "hold"
+	}
+	return fmt.Sprintf("%-10s %4d/%-4d %3d%%  %-40s %s", s.Locale, s.Translated, s.OutOf, s.Percent(), crowdin, publish)
+}
+
+// crowdinLanguage finds the progress for a locale.  Crowdin names
+// languages "fr" or "pt-BR"; the .po files it exports say which in
+// their X-Crowdin-Language header.
+func crowdinLanguage(f *po.File, progress map[string]Progress) (Progress, bool) {
+	candidates := []string{
+		f.Headers["X-Crowdin-Language"],
+		strings.Replace(f.Locale, "_", "-", -1),
+		strings.Split(f.Locale, "_")[0],
+	}
+	for _, lang := range candidates {
+		if p, ok := progress[lang]; ok && lang != "" {
+			return p, true
+		}
+	}
+	return Progress{}, false
+}
+
+// Merge combines the local progress of every locale in files with what
+// Crowdin reported.  A locale is published if it is at least
+// minTranslated percent translated locally, and (if minApproved is set)
+// at least minApproved percent approved on Crowdin; at every review step
+// of the workflow, if there is one (see Progress.Approval).  Pseudo-locales are
+// always published.
+func Merge(files *po.Files, progress map[string]Progress, minTranslated int, minApproved int) []LocaleStatus {
+	ret := []LocaleStatus{}
+	for _, locale := range files.Languages() {
+		f := files.ByLanguage[locale]
+		s := LocaleStatus{Locale: locale, Translated: f.Translated, OutOf: f.OutOf}
+		s.Crowdin, s.OnCrowdin = crowdinLanguage(f, progress)
+		s.Publish = f.Pseudo || (s.Percent() >= minTranslated && (minApproved == 0 || s.Crowdin.Approval() >= minApproved))
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// FetchProgress asks Crowdin for the progress of a source file (ie
+// falling-sky.pot) by language, and saves it as fn for later builds.
+func FetchProgress(c Client, name string, fn string) (map[string]Progress, error) {
+	progress, err := c.Progress(name)
+	if err != nil {
+		return nil, fmt.Errorf("c.Progress(%q): %w", name, err)
+	}
+	b, err := json.MarshalIndent(progress, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return progress, ioutil.WriteFile(fn, b, 0644)
+}
+
+// LoadProgress reads progress saved by FetchProgress.
+func LoadProgress(fn string) (map[string]Progress, error) {
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: not found; run with -sync or -status first", fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	progress := make(map[string]Progress)
+	if err = json.Unmarshal(b, &progress); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return progress, nil
+}
@@ -0,0 +1,234 @@
+package crowdinio
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/falling-sky/fsbuilder/fileutil"
+	"github.com/falling-sky/fsbuilder/po"
+)
+
+// Extract unpacks the .po files of a translations archive into dir,
+// replacing what was there.  Every file is checked before anything is
+// replaced: the archive is unpacked next to dir, and swapped into place
+// with a rename.  Returns what changed, by locale.
+func Extract(archive string, dir string) ([]LocaleChange, error) {
+	z, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", archive, err)
+	}
+	defer z.Close()
+
+	staging := dir + ".new"
+	if err = os.RemoveAll(staging); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(staging, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	count := 0
+	for _, f := range z.File {
+		if f.FileInfo().IsDir() || !strings.HasSuffix(f.Name, ".po") {
+			continue
+		}
+		name := path.Clean(f.Name)
+		if path.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return nil, fmt.Errorf("%s: unsafe path %q", archive, f.Name)
+		}
+		if err = extractFile(f, staging+"/"+name); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", archive, f.Name, err)
+		}
+		if _, err = po.Load(staging + "/" + name); err != nil {
+			return nil, fmt.Errorf("%s: %w", archive, err)
+		}
+		count++
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("%s: no .po files", archive)
+	}
+
+	changes, err := Compare(dir, staging)
+	if err != nil {
+		return nil, err
+	}
+
+	// Swap the new files into place.
+	old := dir + ".old"
+	if err = os.RemoveAll(old); err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(dir); err == nil {
+		if err = os.Rename(dir, old); err != nil {
+			return nil, err
+		}
+	}
+	if err = os.Rename(staging, dir); err != nil {
+		os.Rename(old, dir)
+		return nil, err
+	}
+	return changes, os.RemoveAll(old)
+}
+
+func extractFile(f *zip.File, dest string) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	w, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// LocaleChange summarizes how the translations for a locale changed.
+type LocaleChange struct {
+	Locale  string
+	New     bool // Locale was not there before
+	Gone    bool // Locale is no longer there
+	Added   int  // Strings newly translated
+	Changed int  // Strings translated differently
+	Removed int  // Strings no longer translated
+}
+
+func (c LocaleChange) String() string {
+	switch {
+	case c.New:
+		return fmt.Sprintf("%s: new locale, %d translations", c.Locale, c.Added)
+	case c.Gone:
+		return fmt.Sprintf("%s: removed", c.Locale)
+	}
+	return fmt.Sprintf("%s: %d added, %d changed, %d removed", c.Locale, c.Added, c.Changed, c.Removed)
+}
+
+// loadDir loads every .po file below dir, by locale; and returns the
+// path of each, by locale.  A missing dir has no locales.
+func loadDir(dir string) (map[string]*po.File, map[string]string, error) {
+	ret := make(map[string]*po.File)
+	paths := make(map[string]string)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return ret, paths, nil
+	}
+	files, err := fileutil.FilesInDirRecursive(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f, ".po") {
+			continue
+		}
+		p, err := po.Load(dir + "/" + f)
+		if err != nil {
+			return nil, nil, err
+		}
+		ret[p.Locale] = p
+		paths[p.Locale] = dir + "/" + f
+	}
+	return ret, paths, nil
+}
+
+// translated returns the msgstr for a msgid, if it is translated.
+func translated(f *po.File, msgid string) (string, bool) {
+	if r, ok := f.ByID[msgid]; ok && r.MsgStr != "" && msgid != "" {
+		return r.MsgStr, true
+	}
+	return "", false
+}
+
+// Compare reports, by locale, how the .po files in newDir differ from
+// those in oldDir.  Locales without changes are left out.
+func Compare(oldDir string, newDir string) ([]LocaleChange, error) {
+	before, _, err := loadDir(oldDir)
+	if err != nil {
+		return nil, err
+	}
+	after, _, err := loadDir(newDir)
+	if err != nil {
+		return nil, err
+	}
+
+	locales := []string{}
+	for locale := range before {
+		locales = append(locales, locale)
+	}
+	for locale := range after {
+		if _, ok := before[locale]; !ok {
+			locales = append(locales, locale)
+		}
+	}
+	sort.Strings(locales)
+
+	changes := []LocaleChange{}
+	for _, locale := range locales {
+		b, a := before[locale], after[locale]
+		c := LocaleChange{Locale: locale, New: b == nil, Gone: a == nil}
+		if a != nil {
+			for msgid := range a.ByID {
+				now, ok := translated(a, msgid)
+				if !ok {
+					continue
+				}
+				if b == nil {
+					c.Added++
+				} else if was, ok := translated(b, msgid); !ok {
+					c.Added++
+				} else if was != now {
+					c.Changed++
+				}
+			}
+		}
+		if a != nil && b != nil {
+			for msgid := range b.ByID {
+				if _, ok := translated(b, msgid); ok {
+					if _, ok := translated(a, msgid); !ok {
+						c.Removed++
+					}
+				}
+			}
+		}
+		if c.New || c.Gone || c.Added+c.Changed+c.Removed > 0 {
+			changes = append(changes, c)
+		}
+	}
+	return changes, nil
+}
+
+// Sync downloads the latest translations from Crowdin, and unpacks them
+// into dir (ie translations/dl), reporting what changed.  The archive is
+// kept as archive, so that local edits can be found later (see Push).
+func Sync(c Client, dir string, archive string) error {
+	tmp := archive + ".new"
+	defer os.Remove(tmp)
+
+	if err := Download(c, tmp); err != nil {
+		return err
+	}
+	changes, err := Extract(tmp, dir)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		log.Printf("%s: no changes", dir)
+	}
+	for _, change := range changes {
+		log.Printf("%s", change)
+	}
+	return os.Rename(tmp, archive)
+}
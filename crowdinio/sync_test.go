@@ -0,0 +1,82 @@
+package crowdinio
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testPo(locale string, pairs ...string) string {
+	s := "msgid \"\"\nmsgstr \"Language: " + locale + "\\n\"\n"
+	for i := 0; i+1 < len(pairs); i += 2 {
+		s += "\nmsgid \"" + pairs[i] + "\"\nmsgstr \"" + pairs[i+1] + "\"\n"
+	}
+	return s
+}
+
+func testZip(t *testing.T, fn string, files map[string]string) {
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	w.Close()
+	f.Close()
+}
+
+func TestExtract(t *testing.T) {
+	dir := t.TempDir()
+	dl := dir + "/dl"
+	os.MkdirAll(dl+"/fr", 0755)
+	os.MkdirAll(dl+"/de", 0755)
+	ioutil.WriteFile(dl+"/fr/falling-sky.fr_FR.po", []byte(testPo("fr_FR", "slow", "lent", "fast", "vite", "gone", "parti")), 0644)
+	ioutil.WriteFile(dl+"/de/falling-sky.de_DE.po", []byte(testPo("de_DE", "slow", "langsam")), 0644)
+
+	testZip(t, dir+"/all.zip", map[string]string{
+		"fr/falling-sky.fr_FR.po": testPo("fr_FR", "slow", "lent", "fast", "rapide", "new", "nouveau"),
+		"es/falling-sky.es_ES.po": testPo("es_ES", "slow", "lento"),
+		"README.txt":              "ignored",
+	})
+	changes, err := Extract(dir+"/all.zip", dl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := []string{}
+	for _, c := range changes {
+		found = append(found, c.String())
+	}
+	expected := "de_DE: removed\nes_ES: new locale, 1 translations\nfr_FR: 1 added, 1 changed, 1 removed"
+	if strings.Join(found, "\n") != expected {
+		t.Errorf("Extract changes:\n%s\nexpected:\n%s", strings.Join(found, "\n"), expected)
+	}
+	if _, err := os.Stat(dl + "/de"); !os.IsNotExist(err) {
+		t.Errorf("Extract should have replaced %s", dl)
+	}
+	if _, err := os.Stat(dl + "/README.txt"); !os.IsNotExist(err) {
+		t.Errorf("Extract should only unpack .po files")
+	}
+
+	// Bad archives leave the old files alone.
+	for _, files := range []map[string]string{
+		{"../evil.po": testPo("fr_FR")},
+		{"fr/broken.po": "msgid \"\"\nmsgstr \"\"\n\nmsgid \"x\"\nmsgstr \"y\"\n"},
+		{"README.txt": "no translations"},
+	} {
+		testZip(t, dir+"/bad.zip", files)
+		if _, err := Extract(dir+"/bad.zip", dl); err == nil {
+			t.Errorf("Extract(%v) should have failed", files)
+		}
+		if _, err := os.Stat(dl + "/es/falling-sky.es_ES.po"); err != nil {
+			t.Errorf("Extract(%v) damaged %s: %v", files, dl, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package crowdinio
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/falling-sky/fsbuilder/po"
+)
+
+// UploadState records what was last uploaded as a source file, so that
+// an unchanged .pot file is not uploaded again.
+type UploadState struct {
+	Name     string   // Source file name on Crowdin, ie "falling-sky.pot"
+	FileID   int      // As returned by the upload
+	Revision int      // As returned by the upload
+	Hash     string   // sha256 of Strings
+	Strings  []string // Every msgid, sorted
+}
+
+// potStrings returns every msgid of a .pot file, sorted, and their hash.
+// Only the msgids matter to Crowdin; comments (ie references to the
+// templates) changing is not a reason to upload.
+func potStrings(fn string) ([]string, string, error) {
+	f, err := po.Load(fn)
+	if err != nil {
+		return nil, "", err
+	}
+	ret := []string{}
+	for msgid := range f.ByID {
+		if msgid != "" {
+			ret = append(ret, msgid)
+		}
+	}
+	sort.Strings(ret)
+	return ret, fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(ret, "\x00")))), nil
+}
+
+// loadState reads an UploadState; a missing file is an empty state.
+func loadState(fn string) (*UploadState, error) {
+	s := &UploadState{}
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return s, nil
+}
+
+// diffStrings counts the strings added to, and removed from, a sorted list.
+func diffStrings(before []string, after []string) (added int, removed int) {
+	was := make(map[string]bool)
+	for _, s := range before {
+		was[s] = true
+	}
+	for _, s := range after {
+		if was[s] {
+			delete(was, s)
+		} else {
+			added++
+		}
+	}
+	return added, len(was)
+}
+
+// UploadIfChanged uploads fn (ie falling-sky.pot) like Upload, but only
+// if its strings changed since the upload recorded in stateFn.  Returns
+// whether it was uploaded.
+func UploadIfChanged(c Client, fn string, stateFn string) (bool, error) {
+	name := filepath.Base(fn)
+	strs, hash, err := potStrings(fn)
+	if err != nil {
+		return false, err
+	}
+	state, err := loadState(stateFn)
+	if err != nil {
+		return false, err
+	}
+	if state.Name == name && state.Hash == hash {
+		log.Printf("%s: unchanged since revision %d, not uploading", name, state.Revision)
+		return false, nil
+	}
+
+	added, removed := diffStrings(state.Strings, strs)
+	fileID, revID, err := c.UploadSource(name, fn)
+	if err != nil {
+		return false, fmt.Errorf("c.UploadSource(%q...): %w", fn, err)
+	}
+	log.Printf("%s: %d added, %d removed; uploaded as file ID %d revision %d", name, added, removed, fileID, revID)
+
+	state = &UploadState{Name: name, FileID: fileID, Revision: revID, Hash: hash, Strings: strs}
+	b, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return true, err
+	}
+	return true, ioutil.WriteFile(stateFn, b, 0644)
+}
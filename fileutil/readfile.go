@@ -39,3 +39,11 @@ func ReadFile(fn string) (string, error) {
 	readFileCache.byname[fn] = readFileCacheItem{s: s, e: e}
 	return s, e
 }
+
+// ResetCache forgets every file read so far; use before rebuilding
+// after files have changed on disk.
+func ResetCache() {
+	readFileCache.lock.Lock()
+	defer readFileCache.lock.Unlock()
+	readFileCache.byname = make(map[string]readFileCacheItem)
+}
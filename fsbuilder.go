@@ -3,9 +3,13 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/falling-sky/fsbuilder/assets"
 	"github.com/falling-sky/fsbuilder/crowdinio"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/falling-sky/fsbuilder/config"
@@ -14,13 +18,43 @@ import (
 	"github.com/falling-sky/fsbuilder/job"
 	"github.com/falling-sky/fsbuilder/po"
 	"github.com/falling-sky/fsbuilder/signature"
+	"github.com/falling-sky/fsbuilder/sitemap"
+	"github.com/falling-sky/fsbuilder/tmx"
 )
 
 var configFileName = flag.String("config", "", "config file location (see --example)")
+var checkConfigFlag = flag.Bool("check-config", false, "Check the config file (and the directories and processors it names), print every problem found, then exit.")
 var configHelp = flag.Bool("example", false, "Dump a configuration example to the screen.")
+var profileFlag = flag.String("profile", "", "Build a profile of the config (see Profiles), ie: beta")
+var formatFlag = flag.String("format", "json", "with -example: json, yaml or toml")
+
+// setFlags collects every -set Field.Name=value, in order.
+type setFlags []string
+
+func (s *setFlags) String() string     { return strings.Join(*s, " ") }
+func (s *setFlags) Set(v string) error { *s = append(*s, v); return nil }
+
+var setFlag setFlags
+
+func init() {
+	flag.Var(&setFlag, "set", "Override a config field, ie -set Options.MaxThreads=8 (may be repeated; after the config file and $FSBUILDER_*)")
+}
 
 var updateFlag = flag.String("update", "", "crowdin: filename to update then exit; file must pre-exist on crowdin (ie: falling-sky.pot)")
 var downloadFlag = flag.String("download", "", "crowdin: filename to download then exit (ie: all.zip)")
+var syncFlag = flag.Bool("sync", false, "crowdin: download the latest translations into PoDir/dl, report changes, then exit")
+var uploadFlag = flag.Bool("upload", false, "crowdin: after building, upload the new falling-sky.pot if its strings changed since the last upload")
+var pushFlag = flag.Bool("push", false, "crowdin: upload translations edited in PoDir/dl since the last -sync, then exit")
+var statusFlag = flag.Bool("status", false, "crowdin: report translation and approval progress (at every workflow review step, on Enterprise) by locale, then exit")
+var buildFlag = flag.Bool("build", false, "with -sync: continue into a normal build, instead of exiting")
+
+var lintFlag = flag.Bool("lint", false, "Check templates for problems (as file:line: message) then exit, without building.")
+
+var tmxFlag = flag.String("tmx", "", "Export every translation in PoDir/dl (including obsolete ones) as a TMX translation memory, then exit (ie: falling-sky.tmx)")
+var csvFlag = flag.String("csv", "", "with -tmx, or alone: also export the translations as a CSV glossary (ie: glossary.csv)")
+
+var timingsFlag = flag.Bool("timings", false, "Print the slowest files, locales and phases after building.")
+var traceFlag = flag.String("trace", "", "Write a Chrome trace-event JSON file of all jobs (ie: trace.json)")
 
 func prepOutput(dir string) {
 	log.Printf("Prepping %s\n", dir)
@@ -43,23 +77,76 @@ func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	if *configHelp {
-		fmt.Println(config.Example())
+		example, err := config.ExampleFormat(*formatFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(example)
+		os.Exit(0)
+	}
+	if *profileFlag != "" {
+		setFlag = append(setFlags{"Profile=" + *profileFlag}, setFlag...)
+	}
+	if *checkConfigFlag {
+		_, problems := config.Check(*configFileName, setFlag...)
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if config.Failed(problems) {
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
-	conf, err := config.Load(*configFileName)
+	conf, err := config.Load(*configFileName, setFlag...)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	switch {
-	case *updateFlag != "":
-		crowdinio.UploadAndExit(*updateFlag)
-	case *downloadFlag != "":
-		crowdinio.DownloadAndExit(*downloadFlag)
-	}
+	potFile := conf.Directories.PoDir + "/falling-sky.pot"
+	progressFile := conf.Directories.PoDir + "/.crowdin-progress.json"
+	buildArchive := conf.Directories.PoDir + "/.crowdin-build.zip"
 
-	prepOutput(conf.Directories.OutputDir)
-	prepOutput(conf.Directories.OutputDir + "/htrev")
+	if *updateFlag != "" || *downloadFlag != "" || *syncFlag || *statusFlag || *pushFlag {
+		c, err := crowdinio.Connect(conf.Crowdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		switch {
+		case *updateFlag != "":
+			err = crowdinio.Upload(c, *updateFlag)
+		case *downloadFlag != "":
+			err = crowdinio.Download(c, *downloadFlag)
+		case *syncFlag:
+			err = crowdinio.Sync(c, conf.Directories.PoDir+"/dl", buildArchive)
+			if err == nil && conf.Options.MinApproved > 0 {
+				// The translations are in; a build can go ahead on the
+				// progress saved last time.
+				if _, perr := crowdinio.FetchProgress(c, filepath.Base(potFile), progressFile); perr != nil {
+					log.Printf("WARNING: %v; keeping %s", perr, progressFile)
+				}
+			}
+		case *pushFlag:
+			_, err = crowdinio.Push(c, filepath.Base(potFile), conf.Directories.PoDir+"/dl", buildArchive)
+		case *statusFlag:
+			var progress map[string]crowdinio.Progress
+			var languages *po.Files
+			if progress, err = crowdinio.FetchProgress(c, filepath.Base(potFile), progressFile); err != nil {
+				break
+			}
+			if languages, err = po.LoadAll(potFile, conf.Directories.PoDir+"/dl"); err != nil {
+				break
+			}
+			for _, s := range crowdinio.Merge(languages, progress, conf.Options.MinTranslated, conf.Options.MinApproved) {
+				fmt.Println(s)
+			}
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !*syncFlag || !*buildFlag {
+			os.Exit(0)
+		}
+	}
 
 	var postTable = []job.PostInfoType{
 		{
@@ -69,6 +156,8 @@ func main() {
 			EscapeQuote: false,
 			MultiLocale: false,
 			Compress:    true,
+			References:  true,
+			Fingerprint: true,
 		},
 		{
 			Directory:   "js",
@@ -77,6 +166,7 @@ func main() {
 			EscapeQuote: true,
 			MultiLocale: true,
 			Compress:    true,
+			Fingerprint: true,
 		},
 		{
 			Directory:   "html",
@@ -85,6 +175,24 @@ func main() {
 			EscapeQuote: false,
 			MultiLocale: true,
 			Compress:    true,
+			References:  true,
+			FrontMatter: true,
+			AutoSegment: conf.Options.AutoSegment,
+			After:       []string{"css", "js"},
+		},
+		{
+			Directory:   "markdown",
+			Extension:   ".md",
+			OutputExt:   ".html",
+			PostProcess: conf.Processors.HTML,
+			EscapeQuote: false,
+			MultiLocale: true,
+			Compress:    true,
+			References:  true,
+			FrontMatter: true,
+			Markdown:    true,
+			Optional:    true,
+			After:       []string{"css", "js"},
 		},
 		{
 			Directory:   "php",
@@ -112,22 +220,152 @@ func main() {
 		},
 	}
 
+	if *lintFlag {
+		problems := job.Lint(conf.Directories.TemplateDir, postTable)
+		failed := false
+		for _, p := range problems {
+			fmt.Println(p)
+			failed = failed || !p.Warning
+		}
+		if failed {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *tmxFlag != "" || *csvFlag != "" {
+		languages, err := po.LoadAll(potFile, conf.Directories.PoDir+"/dl")
+		if err != nil {
+			log.Fatal(err)
+		}
+		units := tmx.Units(languages)
+		log.Printf("%d strings, in %d locales", len(units), len(tmx.Locales(units)))
+		if *tmxFlag != "" {
+			b, err := tmx.Generate(units)
+			if err == nil {
+				err = ioutil.WriteFile(*tmxFlag, b, 0644)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *csvFlag != "" {
+			b, err := tmx.CSV(units)
+			if err == nil {
+				err = ioutil.WriteFile(*csvFlag, b, 0644)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		os.Exit(0)
+	}
+
+	// Find what would otherwise stop the build part way (see --check-config);
+	// not before -lint or -tmx, which need neither post processors nor
+	// ImagesDir.
+	if problems := conf.Validate(); len(problems) > 0 {
+		for _, p := range problems {
+			log.Printf("config: %s", p)
+		}
+		if config.Failed(problems) {
+			log.Fatal("config has errors")
+		}
+	}
+
+	prepOutput(conf.Directories.OutputDir)
+	prepOutput(conf.Directories.OutputDir + "/htrev")
+
 	// Start the job queue for templates
 	jobTracker := job.StartQueue(conf.Options.MaxThreads)
 
 	// load all languages, calculate all percentages of completion.
-	languages, err := po.LoadAll(conf.Directories.PoDir+"/falling-sky.pot", conf.Directories.PoDir+"/dl")
+	pseudo := []string{}
+	if conf.Options.Pseudo {
+		pseudo = po.PseudoLocales
+	}
+	languages, err := po.LoadAll(potFile, conf.Directories.PoDir+"/dl", pseudo...)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// Just the locales asked for, if any; checked before any are held
+	// back, as a locale not far enough along is not a mistake.
+	if len(conf.Options.Locales) > 0 {
+		wanted := make(map[string]bool)
+		for _, locale := range conf.Options.Locales {
+			if languages.ByLanguage[locale] == nil {
+				log.Fatalf("Options.Locales: %s: no translations in %s/dl", locale, conf.Directories.PoDir)
+			}
+			wanted[locale] = true
+		}
+		for locale := range languages.ByLanguage {
+			if !wanted[locale] && !po.IsPseudo(locale) {
+				delete(languages.ByLanguage, locale)
+			}
+		}
+	}
+	// Hold back locales that are not far enough along (see --status).
+	if conf.Options.MinTranslated > 0 || conf.Options.MinApproved > 0 {
+		var progress map[string]crowdinio.Progress
+		if conf.Options.MinApproved > 0 {
+			if progress, err = crowdinio.LoadProgress(progressFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		for _, s := range crowdinio.Merge(languages, progress, conf.Options.MinTranslated, conf.Options.MinApproved) {
+			if !s.Publish {
+				log.Printf("Not publishing %s", s)
+				delete(languages.ByLanguage, s.Locale)
+			}
+		}
+	}
 	languages.Pot.Locale = "en_US"
 	languages.Pot.Language = "English"
 
 	// Grab this just once.
 	cachedGitInfo := gitinfo.GetGitInfo()
 
+	// Shared by all jobs; tracks which assets each page references,
+	// and the content-hashed names of fingerprinted assets.
+	rewriter := assets.NewRewriter(conf.Rewrite)
 	for _, tt := range postTable {
+		if tt.Fingerprint {
+			ext := tt.Extension
+			if tt.OutputExt != "" {
+				ext = tt.OutputExt
+			}
+			rewriter.Built[ext] = tt.Directory
+		}
+	}
+
+	// Job names by directory, so later types can depend on earlier ones;
+	// and the directories queued so far.
+	jobNames := make(map[string][]string)
+	queued := make(map[string]bool)
+
+	// Output names taken so far, and the template writing each; so that
+	// ie markdown/faq.md and html/faq.html don't overwrite each other.
+	outputs := make(map[string]string)
+
+	// Pages to list in sitemap.xml (the en_US job of each).
+	sitemapJobs := []*job.QueueItem{}
+
+	// queueFiles launches the jobs for every template of a given type.
+	queueFiles := func(tt job.PostInfoType) {
+		dependsOn := []string{}
+		for _, dir := range tt.After {
+			if !queued[dir] {
+				log.Fatalf("%s: After %q: no such directory queued before it", tt.Directory, dir)
+			}
+			dependsOn = append(dependsOn, jobNames[dir]...)
+		}
+		queued[tt.Directory] = true
+
 		inputDir := conf.Directories.TemplateDir + "/" + tt.Directory
+		if _, err := os.Stat(inputDir); tt.Optional && os.IsNotExist(err) {
+			return
+		}
 		files, err := fileutil.FilesInDirNotRecursive(inputDir)
 		if err != nil {
 			log.Fatal(err)
@@ -136,8 +374,22 @@ func main() {
 
 		rootDir := conf.Directories.TemplateDir + "/" + tt.Directory
 		addLanguages := languages.ApacheAddLanguage()
+		published := languages.Published()
 		signature := signature.ScanDir(rootDir, addLanguages)
 
+		// Front matter of every page, so that templates can build navigation.
+		var pages map[string]*job.Page
+		if tt.FrontMatter {
+			pages = make(map[string]*job.Page)
+			for _, file := range files {
+				if strings.HasSuffix(file, tt.Extension) {
+					if pages[file], err = job.LoadPage(rootDir, file); err != nil {
+						log.Fatal(err)
+					}
+				}
+			}
+		}
+
 		// Wrapper for launch jobs, gets all the variables into place and in scope
 		launcher := func(file string, locale string, pofile *po.File) {
 
@@ -145,22 +397,38 @@ func main() {
 			// the templates will ask about.
 			td := &job.TemplateData{
 				GitInfo:      cachedGitInfo,
-				PoMap:        languages.ByLanguage,
+				PoMap:        published,
 				Basename:     strings.Split(file, ".")[0],
 				AddLanguage:  addLanguages,
 				DirSignature: signature,
+				Page:         pages[file],
+				Pages:        pages,
+				Profile:      job.Profile{Name: conf.Profile, Vars: conf.Vars},
 			}
 
-			job := &job.QueueItem{
-				Config:   conf,
-				RootDir:  rootDir,
-				Filename: file,
-				PoFile:   pofile,
-				PotFile:  languages.Pot,
-				Data:     td,
-				PostInfo: tt,
+			qi := &job.QueueItem{
+				Config:    conf,
+				RootDir:   rootDir,
+				Filename:  file,
+				PoFile:    pofile,
+				PotFile:   languages.Pot,
+				Data:      td,
+				PostInfo:  tt,
+				Assets:    rewriter,
+				DependsOn: dependsOn,
 			}
-			jobTracker.Add(job)
+			jobNames[tt.Directory] = append(jobNames[tt.Directory], qi.Name())
+			if locale == "en_US" {
+				name, source := job.OutputName(qi), tt.Directory+"/"+file
+				if other, ok := outputs[name]; ok && other != source {
+					log.Fatalf("%s: output %s is also written by %s", source, name, other)
+				}
+				outputs[name] = source
+			}
+			if tt.FrontMatter && locale == "en_US" && td.Page.Sitemap {
+				sitemapJobs = append(sitemapJobs, qi)
+			}
+			jobTracker.Add(qi)
 
 		}
 
@@ -182,6 +450,17 @@ func main() {
 	fileutil.CopyFiles(conf.Directories.ImagesDir, conf.Directories.OutputDir+"/images")
 	fileutil.CopyFiles(conf.Directories.ImagesDir, conf.Directories.OutputDir+"/images-nc")
 	// fileutil.CopyFilesAll(conf.Directories.TransparentDir, conf.Directories.OutputDir+"/transparent")
+	for _, dir := range []string{"images", "images-nc"} {
+		if err = rewriter.Manifest.AddDir(conf.Directories.OutputDir, dir); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Jobs run in dependency order (see After); so pages are expanded
+	// only once the assets they reference have been built and hashed.
+	for _, tt := range postTable {
+		queueFiles(tt)
+	}
 
 	// A couple last minute symlinks
 	os.Symlink(".", conf.Directories.OutputDir+"/isp")
@@ -189,11 +468,87 @@ func main() {
 
 	// Wait for all process jobs to finish
 	jobTracker.Wait()
+	if *timingsFlag {
+		fmt.Print(jobTracker.Summary(10))
+	}
+	if *traceFlag != "" {
+		if err = jobTracker.WriteTrace(*traceFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// References to assets that were not built are usually typos.
+	missing := rewriter.Graph.Missing(func(asset string) bool {
+		return assets.Exists(conf.Directories.OutputDir, asset)
+	})
+	missingAssets := []string{}
+	for asset := range missing {
+		missingAssets = append(missingAssets, asset)
+	}
+	sort.Strings(missingAssets)
+	for _, asset := range missingAssets {
+		log.Printf("WARNING: %s: referenced by %s, but not in %s\n", asset, strings.Join(missing[asset], ", "), conf.Directories.OutputDir)
+	}
+
+	// sitemap.xml and robots.txt; pages are dated by the last commit
+	// to the template or anything it includes.  Without a BaseURL there
+	// is no sitemap.xml, so no need to ask git.
+	sitemapPages := []sitemap.Page{}
+	for _, qi := range sitemapJobs {
+		if conf.Sitemap.BaseURL == "" {
+			break
+		}
+		_, included, err := job.ResolveIncludes(qi.RootDir, qi.Filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sources := []string{}
+		for _, f := range included {
+			sources = append(sources, qi.RootDir+"/"+f.Name)
+		}
+		lastmod, err := gitinfo.GitFileDate(sources...)
+		if err != nil {
+			log.Printf("WARNING: sitemap.xml: %s: no lastmod: %v\n", job.OutputName(qi), err)
+		}
+		sitemapPages = append(sitemapPages, sitemap.Page{
+			Name:    job.OutputName(qi),
+			Lastmod: lastmod,
+		})
+	}
+	locales := []string{"en_US"}
+	for locale := range languages.Published() {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales[1:])
+	if err = sitemap.Write(conf.Directories.OutputDir, conf.Sitemap.BaseURL, conf.Sitemap.Robots, sitemapPages, locales); err != nil {
+		log.Fatal(err)
+	}
+
+	// Write out the content-hashed copies of fingerprinted assets, and
+	// the manifest.
+	rewriter.Seal()
+	if err = rewriter.Manifest.Link(conf.Directories.OutputDir); err != nil {
+		log.Fatal(err)
+	}
+	if err = rewriter.Manifest.Save(conf.Directories.OutputDir + "/manifest.json"); err != nil {
+		log.Fatal(err)
+	}
 
 	// Write out the new .POT file for translators
-	err = languages.Pot.Save(conf.Directories.PoDir + "/falling-sky.pot")
+	err = languages.Pot.Save(potFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// And hand it to them, if there is anything new.
+	if *uploadFlag {
+		c, err := crowdinio.Connect(conf.Crowdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err = crowdinio.UploadIfChanged(c, potFile, conf.Directories.PoDir+"/.crowdin-upload.json"); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 }
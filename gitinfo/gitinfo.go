@@ -86,6 +86,21 @@ func GitDate() string {
 	return s
 }
 
+// GitFileDate gets the date of the latest commit that touched any of the
+// named files, in strict ISO 8601 format (as used by sitemap.xml).
+// Returns "" if none of them have been committed.  Unlike the rest of
+// GitInfo, failing is not fatal; the date is optional where it is used.
+func GitFileDate(files ...string) (string, error) {
+	args := append([]string{"log", "-1", `--format=%cI`, "--"}, files...)
+	cmd := exec.Command("git", args...)
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("running %#v %#v: %v: %s", cmd.Path, cmd.Args, err, strings.TrimSpace(string(b)))
+	}
+	s := strings.TrimSpace(string(b))
+	return s, nil
+}
+
 // GitRepository reports the current repo name
 // (useful when people fork the project)
 func GitRepository() string {
@@ -1 +1,19 @@
 package gitinfo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGitFileDate(t *testing.T) {
+	s, err := GitFileDate("gitinfo.go")
+	if err != nil {
+		t.Skipf("not in a git checkout: %v", err)
+	}
+	if _, err := time.Parse(time.RFC3339, s); err != nil {
+		t.Errorf("GitFileDate(gitinfo.go)=%q: %v", s, err)
+	}
+	if _, err := GitFileDate("/"); err == nil {
+		t.Errorf("GitFileDate of a path outside the checkout should fail")
+	}
+}
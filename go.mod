@@ -3,8 +3,12 @@ module github.com/falling-sky/fsbuilder
 go 1.17
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/fabdem/go-crowdinv2 v1.0.2
+	github.com/yuin/goldmark v1.4.11
+	golang.org/x/net v0.17.0
 	golang.org/x/text v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require github.com/mreiferson/go-httpclient v0.0.0-20201222173833-5e475fde3a4d // indirect
@@ -0,0 +1,180 @@
+package job
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/falling-sky/fsbuilder/fileutil"
+	"github.com/falling-sky/fsbuilder/po"
+)
+
+// parsedEntry is a single expanded (but untranslated) template.
+// ready is closed once content has been filled in; until then,
+// other jobs wanting the same template wait on it.
+type parsedEntry struct {
+	ready    chan struct{}
+	segments Segments
+	files    []IncludedFile
+	deps     *Dependencies
+	auto     []string // Strings found by SegmentTemplate
+
+	lock sync.Mutex
+	pots map[*po.File]bool // .pot files the strings were added to
+}
+
+// ParsedCacheType provides properly mutex locked cache access to
+// the expanded (but untranslated) templates.  Entries are keyed by the
+// content of the template and everything it includes, so that each
+// template is expanded once (while other templates expand in parallel),
+// and a rebuild with changed files gets a fresh expansion (after
+// fileutil.ResetCache).
+type ParsedCacheType struct {
+	lock   sync.Mutex
+	byname map[string]*parsedEntry
+}
+
+// ParsedCache holds the actual cache of expanded (but not translated) templates.
+var ParsedCache ParsedCacheType
+
+func init() {
+	ParsedCache.byname = make(map[string]*parsedEntry)
+}
+
+// Key summarizes the template data, for use in cache keys.
+func (td *TemplateData) Key() string {
+	if td == nil {
+		return ""
+	}
+	h := sha256.New()
+	if td.GitInfo != nil {
+		fmt.Fprintf(h, "%#v\n", *td.GitInfo)
+	}
+	locales := []string{}
+	for locale := range td.PoMap {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	for _, locale := range locales {
+		fmt.Fprintf(h, "%s=%s\n", locale, td.PoMap[locale].PercentTranslated)
+	}
+	fmt.Fprintf(h, "%s\n%s\n%s\n", td.Basename, td.AddLanguage, td.DirSignature)
+	fmt.Fprintf(h, "%s\n", td.Page.Key())
+	vars := []string{}
+	for k, v := range td.Profile.Vars {
+		vars = append(vars, k+"="+v)
+	}
+	sort.Strings(vars)
+	fmt.Fprintf(h, "profile %s\n%s\n", td.Profile.Name, strings.Join(vars, "\n"))
+	names := []string{}
+	for name := range td.Pages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s:\n%s\n", name, td.Pages[name].Key())
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// cacheKey identifies an expansion of a template: its name,
+// the content of every file in the include chain, and the template data.
+func cacheKey(qi *QueueItem, files []IncludedFile) string {
+	h := sha256.New()
+	io.WriteString(h, qi.RootDir+"/"+qi.Filename+"\x00")
+	for _, f := range files {
+		io.WriteString(h, f.Name+"\x00"+f.Content+"\x00")
+	}
+	io.WriteString(h, qi.Data.Key())
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// stale reports whether any asset looked up during expansion now
+// resolves to a different name, or any raw file read has changed.
+func (e *parsedEntry) stale(qi *QueueItem) bool {
+	for name, s := range e.deps.Assets {
+		if qi.Assets != nil && qi.Assets.Manifest.Lookup(name) != s {
+			return true
+		}
+	}
+	for fn, c := range e.deps.Files {
+		if now, err := fileutil.ReadFile(fn); err != nil || now != c {
+			return true
+		}
+	}
+	return false
+}
+
+// updatePot adds the strings of the template to the job's .pot file,
+// unless they were already added to it.
+func (e *parsedEntry) updatePot(qi *QueueItem) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.pots[qi.PotFile] {
+		return
+	}
+	e.pots[qi.PotFile] = true
+	UpdatePotFiles(qi, e.files)
+	for _, s := range e.auto {
+		qi.PotFile.Add(s, qi.Filename, qi.PostInfo.EscapeQuote)
+	}
+}
+
+// Get returns the expanded (but untranslated) template for a job, split
+// into segments; expanding it if no other job has.  The strings found in
+// the template are added to the job's .pot file once.
+func (pc *ParsedCacheType) Get(qi *QueueItem) Segments {
+	content, files := GrabIncludes(qi)
+	key := cacheKey(qi, files)
+
+	for {
+		pc.lock.Lock()
+		e, ok := pc.byname[key]
+		if !ok {
+			e = &parsedEntry{
+				ready: make(chan struct{}),
+				files: files,
+				deps:  NewDependencies(),
+				pots:  make(map[*po.File]bool),
+			}
+			pc.byname[key] = e
+		}
+		pc.lock.Unlock()
+
+		if !ok {
+			// log.Printf("not cached: %s", qi.Filename)
+			if qi.PostInfo.AutoSegment {
+				content, e.auto = SegmentTemplate(content)
+			}
+			expanded := processTemplate(qi, content, e.deps)
+			e.segments = Tokenize(expanded)
+			e.updatePot(qi)
+			close(e.ready)
+			return e.segments
+		}
+
+		<-e.ready
+		if e.stale(qi) {
+			pc.lock.Lock()
+			if pc.byname[key] == e {
+				delete(pc.byname, key)
+			}
+			pc.lock.Unlock()
+			continue
+		}
+
+		// log.Printf("cached: %s", qi.Filename)
+		e.updatePot(qi)
+		return e.segments
+	}
+}
+
+// Reset empties the cache.
+func (pc *ParsedCacheType) Reset() {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	pc.byname = make(map[string]*parsedEntry)
+}
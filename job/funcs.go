@@ -0,0 +1,180 @@
+package job
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/falling-sky/fsbuilder/fileutil"
+)
+
+// Dependencies notes what a template expansion used beyond its include
+// chain, so that a cached expansion can be checked for staleness.
+type Dependencies struct {
+	Assets map[string]string // asset name -> what it resolved to
+	Files  map[string]string // raw file read -> its content
+}
+
+// NewDependencies returns an empty Dependencies.
+func NewDependencies() *Dependencies {
+	return &Dependencies{
+		Assets: make(map[string]string),
+		Files:  make(map[string]string),
+	}
+}
+
+// gitDateLayout is how "git log --format=%cd" prints dates.
+const gitDateLayout = "Mon Jan 2 15:04:05 2006 -0700"
+
+// parseDate accepts a time.Time, or a string in git's or RFC 3339 format.
+func parseDate(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		for _, layout := range []string{gitDateLayout, time.RFC3339, "2006-01-02"} {
+			if parsed, err := time.Parse(layout, t); err == nil {
+				return parsed, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("date: can't parse %q", t)
+	}
+	return time.Time{}, fmt.Errorf("date: can't use %T", v)
+}
+
+// readRaw reads root/name for the include and readFile functions.
+// Names may not be absolute, nor climb out of root.
+func readRaw(fn string, root string, name string, deps *Dependencies) (string, error) {
+	if clean := path.Clean(name); path.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%s %q: must be a relative path", fn, name)
+	}
+	fullname := root + "/" + name
+	c, err := fileutil.ReadFile(fullname)
+	if err != nil {
+		return "", err
+	}
+	if deps != nil {
+		deps.Files[fullname] = c
+	}
+	return c, nil
+}
+
+// checkBuilt makes sure that an asset built from templates is complete
+// before a template asks for its hashed name or digest: the directory
+// building it must be in After.  Otherwise the name would be taken from
+// whichever variants happened to be written so far.
+func checkBuilt(qi *QueueItem, fn string, name string) error {
+	if qi.Assets == nil {
+		return nil
+	}
+	dir, ok := qi.Assets.Built[path.Ext(name)]
+	if !ok {
+		return nil
+	}
+	for _, after := range qi.PostInfo.After {
+		if after == dir {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %q: built by %s templates, which %s templates must list in After", fn, name, dir, qi.PostInfo.Directory)
+}
+
+// TemplateFuncs returns the functions available to templates in [% %].
+// The template is expanded once for all locales; so per-locale helpers
+// return {{ placeholders }}, which are filled in during translation.
+// See README.md for the full list.
+func TemplateFuncs(qi *QueueItem, deps *Dependencies) template.FuncMap {
+	FuncMap := make(template.FuncMap)
+
+	FuncMap["EXAMPLE"] = func(name string) (string, error) {
+		//log.Printf("PROCESS: %v\n", name)
+		return "", nil
+	}
+
+	// Strings
+	FuncMap["lower"] = strings.ToLower
+	FuncMap["upper"] = strings.ToUpper
+	FuncMap["title"] = strings.Title
+	FuncMap["trim"] = strings.TrimSpace
+	FuncMap["trimPrefix"] = func(prefix string, s string) string { return strings.TrimPrefix(s, prefix) }
+	FuncMap["trimSuffix"] = func(suffix string, s string) string { return strings.TrimSuffix(s, suffix) }
+	FuncMap["replace"] = func(old string, new string, s string) string { return strings.Replace(s, old, new, -1) }
+	FuncMap["contains"] = func(substr string, s string) bool { return strings.Contains(s, substr) }
+	FuncMap["hasPrefix"] = func(prefix string, s string) bool { return strings.HasPrefix(s, prefix) }
+	FuncMap["hasSuffix"] = func(suffix string, s string) bool { return strings.HasSuffix(s, suffix) }
+	FuncMap["split"] = func(sep string, s string) []string { return strings.Split(s, sep) }
+	FuncMap["join"] = func(sep string, list []string) string { return strings.Join(list, sep) }
+	FuncMap["default"] = func(def string, s string) string {
+		if s == "" {
+			return def
+		}
+		return s
+	}
+
+	// Raw snippets; not expanded, not translated.
+	FuncMap["include"] = func(name string) (string, error) {
+		return readRaw("include", qi.RootDir, locateInclude(qi.RootDir, qi.Filename, name), deps)
+	}
+	FuncMap["readFile"] = func(name string) (string, error) {
+		if qi.Config == nil {
+			return "", fmt.Errorf("readFile %q: no TemplateDir", name)
+		}
+		return readRaw("readFile", qi.Config.Directories.TemplateDir, name, deps)
+	}
+
+	// Assets
+	FuncMap["asset"] = func(name string) (string, error) {
+		if qi.Assets == nil {
+			return name, nil
+		}
+		if err := checkBuilt(qi, "asset", name); err != nil {
+			return "", err
+		}
+		s := qi.Assets.Manifest.Lookup(name)
+		if deps != nil {
+			deps.Assets[name] = s
+		}
+		return s, nil
+	}
+	FuncMap["integrity"] = func(name string) (string, error) {
+		if err := checkBuilt(qi, "integrity", name); err != nil {
+			return "", err
+		}
+		return "[%integrity " + name + "%]", nil
+	}
+
+	// Data
+	FuncMap["json"] = func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+	FuncMap["date"] = func(layout string, v interface{}) (string, error) {
+		t, err := parseDate(v)
+		if err != nil {
+			return "", err
+		}
+		return t.UTC().Format(layout), nil
+	}
+	FuncMap["env"] = func(name string) (string, error) {
+		if qi.Config != nil {
+			for _, allowed := range qi.Config.Options.Env {
+				if allowed == name {
+					return os.Getenv(name), nil
+				}
+			}
+		}
+		return "", fmt.Errorf("env %q: not listed in Options.Env", name)
+	}
+
+	// Per-locale; see po.File.Translate
+	for _, name := range []string{"lang", "langUC", "locale", "langname", "percenttranslated", "dir"} {
+		placeholder := "{{" + name + "}}"
+		FuncMap[name] = func() string { return placeholder }
+	}
+
+	return FuncMap
+}
@@ -0,0 +1,220 @@
+package job
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+	"unicode"
+
+	nethtml "golang.org/x/net/html"
+)
+
+// SegmentAttributes are the attributes whose values SegmentHTML treats
+// as translatable.
+var SegmentAttributes = []string{"title", "alt", "placeholder"}
+
+// reSEGMENTATTR matches a quoted title, alt or placeholder attribute
+// inside a raw start tag.
+var reSEGMENTATTR = regexp.MustCompile(`(\s(?:` + strings.Join(SegmentAttributes, "|") + `)\s*=\s*)("[^"]*"|'[^']*')`)
+
+// segmentSkip are elements whose content is never translated.
+var segmentSkip = map[string]bool{"script": true, "style": true, "code": true}
+
+// translatable reports whether raw html text is worth translating: it has
+// some letters in it, and has not already been marked with {{ }}.
+func translatable(raw string) bool {
+	if strings.Contains(raw, "{{") {
+		return false
+	}
+	return strings.IndexFunc(html.UnescapeString(raw), unicode.IsLetter) >= 0
+}
+
+// wrap puts {{ }} around raw text, leaving surrounding whitespace outside.
+func wrap(raw string) string {
+	trimmed := strings.TrimSpace(raw)
+	start := strings.Index(raw, trimmed)
+	return raw[:start] + "{{" + trimmed + "}}" + raw[start+len(trimmed):]
+}
+
+// stillOpen reports whether a {{ is left open at the end of s; open
+// says whether one was open at its start.
+func stillOpen(s string, open bool) bool {
+	for {
+		if open {
+			i := strings.Index(s, "}}")
+			if i < 0 {
+				return true
+			}
+			s, open = s[i+2:], false
+		} else {
+			i := strings.Index(s, "{{")
+			if i < 0 {
+				return false
+			}
+			s, open = s[i+2:], true
+		}
+	}
+}
+
+// htmlUnit is a translatable piece of an html document, and where it
+// starts (in bytes).
+type htmlUnit struct {
+	Offset int
+	Text   string
+}
+
+// SegmentHTML finds the translatable text in an html document that has not
+// been marked with {{ }}: every text node, and the title, alt and
+// placeholder attributes.  It returns the document with {{ }} added around
+// each, and the list of strings it marked.
+//
+// The content of script, style and code elements is skipped, as is
+// anything inside an element with translate="no".  Text that already holds
+// a {{ }} (including per-locale placeholders, such as {{lang}}) is left
+// as is; and so is everything inside a {{ }} that spans several elements,
+// ie {{Because <em>we are</em> out of addresses}}.
+func SegmentHTML(content string) (string, []string) {
+	out, units := segmentHTML(content)
+	found := []string{}
+	for _, u := range units {
+		found = append(found, u.Text)
+	}
+	return out, found
+}
+
+// SegmentTemplate is SegmentHTML for a template, before it is expanded:
+// [% %] directives are skipped over, and text with a directive in it is
+// left alone; so that only text written in the template becomes a msgid,
+// not text the template generates (ie a date, or a commit hash).
+func SegmentTemplate(content string) (string, []string) {
+	stripped := reDIRECTIVE.ReplaceAllStringFunc(content, blank)
+	_, units := segmentHTML(stripped)
+	b := &strings.Builder{}
+	found := []string{}
+	last := 0
+	for _, u := range units {
+		start := u.Offset + strings.Index(stripped[u.Offset:], u.Text)
+		end := start + len(u.Text)
+		if strings.Contains(content[start:end], "[%") {
+			continue
+		}
+		b.WriteString(content[last:start])
+		b.WriteString("{{" + u.Text + "}}")
+		last = end
+		found = append(found, u.Text)
+	}
+	b.WriteString(content[last:])
+	return b.String(), found
+}
+
+// segmentHTML does the work of SegmentHTML, noting where each string was.
+func segmentHTML(content string) (string, []htmlUnit) {
+	z := nethtml.NewTokenizer(strings.NewReader(content))
+	b := &bytes.Buffer{}
+	found := []htmlUnit{}
+
+	skipTag := ""
+	skipDepth := 0
+	offset := 0
+	open := false // Inside a {{ that started in an earlier text node
+
+	// text marks a text node (or what follows a }} in one), at start.
+	text := func(raw string, start int) string {
+		if translatable(raw) {
+			trimmed := strings.TrimSpace(raw)
+			found = append(found, htmlUnit{Offset: start + strings.Index(raw, trimmed), Text: trimmed})
+			raw = wrap(raw)
+		}
+		// A {{ never closed is lint's to report, not a reason to skip the rest.
+		open = stillOpen(raw, false) && strings.Contains(content[offset:], "}}")
+		return raw
+	}
+
+	for {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			if z.Err() != io.EOF {
+				// Not html we understand; leave the remainder alone.
+				b.Write(z.Raw())
+			}
+			break
+		}
+		raw := string(z.Raw())
+		start := offset
+		offset += len(raw)
+
+		switch tt {
+		case nethtml.StartTagToken, nethtml.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			tag := string(name)
+			optOut := false
+			for hasAttr {
+				var k, v []byte
+				k, v, hasAttr = z.TagAttr()
+				if string(k) == "translate" && strings.EqualFold(string(v), "no") {
+					optOut = true
+				}
+			}
+			if skipDepth > 0 {
+				if tag == skipTag && tt == nethtml.StartTagToken {
+					skipDepth++
+				}
+				break
+			}
+			if optOut || segmentSkip[tag] {
+				if tt == nethtml.StartTagToken && !voidElements[tag] {
+					skipTag, skipDepth = tag, 1
+				}
+				break
+			}
+			if open {
+				break
+			}
+			rewritten := &strings.Builder{}
+			last := 0
+			for _, m := range reSEGMENTATTR.FindAllStringSubmatchIndex(raw, -1) {
+				value := raw[m[4]+1 : m[5]-1]
+				if !translatable(value) {
+					continue
+				}
+				found = append(found, htmlUnit{Offset: start + m[4] + 1, Text: strings.TrimSpace(value)})
+				rewritten.WriteString(raw[last : m[4]+1])
+				rewritten.WriteString(wrap(value))
+				last = m[5] - 1
+			}
+			rewritten.WriteString(raw[last:])
+			raw = rewritten.String()
+
+		case nethtml.EndTagToken:
+			name, _ := z.TagName()
+			if skipDepth > 0 && string(name) == skipTag {
+				skipDepth--
+			}
+
+		case nethtml.TextToken:
+			if skipDepth > 0 {
+				break
+			}
+			if !open {
+				raw = text(raw, start)
+				break
+			}
+			i := strings.Index(raw, "}}")
+			if i < 0 {
+				break
+			}
+			raw = raw[:i+2] + text(raw[i+2:], start+i+2)
+		}
+		b.WriteString(raw)
+	}
+	return b.String(), found
+}
+
+// voidElements never have an end tag.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
@@ -0,0 +1,172 @@
+package job
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/falling-sky/fsbuilder/fileutil"
+)
+
+// rePROCESS matches on   [% PROCESS "filename" %]
+// and captures the entire template directive as well as the inside filename,
+// plus any parameters:   [% PROCESS "filename" title="About" page=$page %]
+var rePROCESS = regexp.MustCompile(`\[\%\s*PROCESS\s*"(.*?)"((?:\s+\w+=(?:"(?:[^"\\]|\\.)*"|[^\s"%]+))*)\s*\%\]`)
+
+// reACTION matches the start of a [% keyword ... %] action.
+var reACTION = regexp.MustCompile(`\[%-?\s*(\w+)`)
+
+// rePARAM matches a single name=value parameter of a PROCESS directive.
+var rePARAM = regexp.MustCompile(`(\w+)=("(?:[^"\\]|\\.)*"|[^\s"%]+)`)
+
+// IncludedFile is one of the files a template was assembled from.
+type IncludedFile struct {
+	Name    string // Relative to RootDir
+	Content string
+}
+
+// IncludeError describes a failed include, with the chain of files
+// that led to it.
+type IncludeError struct {
+	Chain []string
+	Err   error
+}
+
+func (e *IncludeError) Error() string {
+	return fmt.Sprintf("include %s: %v", strings.Join(e.Chain, " -> "), e.Err)
+}
+
+// ResolveIncludes reads root/name and replaces each PROCESS directive with
+// the content of the named file, recursively.  It returns the assembled
+// content, and the files it was assembled from (each once, in order).
+//
+// Included names are looked up next to the including file first, then
+// relative to root.  Parameters become template variables that are only
+// visible inside the included content:
+//
+//	[% PROCESS "header.inc" title="About" %]
+//
+// is expanded as
+//
+//	[% if true %][% $title := "About" %]...header.inc...[% end %]
+//
+// Any [% define %] blocks in such an include are moved to the end of the
+// document, since Go templates only allow them at the top level.
+// Including a file from itself (directly or not) is an error.
+func ResolveIncludes(root string, name string) (string, []IncludedFile, error) {
+	files := []IncludedFile{}
+	seen := make(map[string]bool)
+	hoisted := &strings.Builder{}
+
+	var include func(name string, stack []string) (string, error)
+	include = func(name string, stack []string) (string, error) {
+		for _, s := range stack {
+			if s == name {
+				return "", &IncludeError{Chain: append(stack, name), Err: fmt.Errorf("include cycle")}
+			}
+		}
+		stack = append(stack, name)
+
+		content, err := fileutil.ReadFile(root + "/" + name)
+		if err != nil {
+			return "", &IncludeError{Chain: stack, Err: err}
+		}
+		if !seen[name] {
+			seen[name] = true
+			files = append(files, IncludedFile{Name: name, Content: content})
+		}
+
+		b := &strings.Builder{}
+		last := 0
+		for _, m := range rePROCESS.FindAllStringSubmatchIndex(content, -1) {
+			b.WriteString(content[last:m[0]])
+			last = m[1]
+
+			inside := content[m[2]:m[3]]
+			params := content[m[4]:m[5]]
+			target := locateInclude(root, name, inside)
+
+			// Copy the stack, so that siblings don't share the backing array.
+			expanded, err := include(target, append([]string{}, stack...))
+			if err != nil {
+				return "", err
+			}
+			if params == "" {
+				b.WriteString(expanded)
+				continue
+			}
+			body, defines := hoistDefines(expanded)
+			hoisted.WriteString(defines)
+			b.WriteString("[% if true %]")
+			for _, p := range rePARAM.FindAllStringSubmatch(params, -1) {
+				b.WriteString("[% $" + p[1] + " := " + p[2] + " %]")
+			}
+			b.WriteString(body)
+			b.WriteString("[% end %]")
+		}
+		b.WriteString(content[last:])
+		return b.String(), nil
+	}
+
+	content, err := include(name, nil)
+	return content + hoisted.String(), files, err
+}
+
+// hoistDefines splits the top level [% define %]...[% end %] blocks out of
+// content.  It returns what remains, and the define blocks.
+func hoistDefines(content string) (string, string) {
+	body := &strings.Builder{}
+	defines := &strings.Builder{}
+	last := 0 // End of what has been copied so far
+	depth := 0
+	start := -1 // Start of the define block being hoisted
+	for _, m := range reACTION.FindAllStringSubmatchIndex(content, -1) {
+		if m[0] < last {
+			continue
+		}
+		switch content[m[2]:m[3]] {
+		case "define":
+			if depth == 0 {
+				start = m[0]
+			}
+			depth++
+		case "if", "range", "with", "block":
+			if start >= 0 {
+				depth++
+			}
+		case "end":
+			if start < 0 {
+				continue
+			}
+			depth--
+			if depth == 0 {
+				end := strings.Index(content[m[1]:], "%]")
+				if end < 0 {
+					break // Unterminated; leave it for the template parser to report.
+				}
+				end += m[1] + 2
+				body.WriteString(content[last:start])
+				defines.WriteString(content[start:end])
+				last = end
+				start = -1
+			}
+		}
+	}
+	body.WriteString(content[last:])
+	return body.String(), defines.String()
+}
+
+// locateInclude finds an included file: next to the including file if
+// it exists there, otherwise relative to root.
+func locateInclude(root string, from string, name string) string {
+	dir := path.Dir(from)
+	if dir != "." {
+		nearby := path.Join(dir, name)
+		if _, err := os.Stat(root + "/" + nearby); err == nil {
+			return nearby
+		}
+	}
+	return name
+}
@@ -3,6 +3,7 @@ package job
 import (
 	"bytes"
 	"compress/gzip"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -10,20 +11,22 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 
+	"github.com/falling-sky/fsbuilder/assets"
 	"github.com/falling-sky/fsbuilder/config"
-	"github.com/falling-sky/fsbuilder/fileutil"
 	"github.com/falling-sky/fsbuilder/gitinfo"
 	"github.com/falling-sky/fsbuilder/po"
 )
 
-// rePROCESS matches on   [% PROCESS "filename" %]
-// and captures the entire template directivel as well as the inside filename.
-var rePROCESS = regexp.MustCompile(`\[\%\s*PROCESS\s*"(.*?)"\s*\%\]`)
-var reTRANSLATE = regexp.MustCompile(`(?ms){{(.*?)}}`)
+// reINTEGRITY matches the marker left behind by the "integrity" template
+// function.  Digests differ per locale, but templates are expanded once for
+// all locales; so the marker is resolved after translation.
+var reINTEGRITY = regexp.MustCompile(`\[%integrity (\S+?)%\]`)
 
 // PostType describes a directory, and how to process it.
 type PostInfoType struct {
@@ -33,6 +36,14 @@ type PostInfoType struct {
 	EscapeQuote bool
 	MultiLocale bool
 	Compress    bool
+	After       []string // Directories whose jobs must finish first; queued earlier
+	References  bool     // Scan output for asset references, and rewrite them
+	Fingerprint bool     // Record output in the asset manifest, for content-hashed names
+	FrontMatter bool     // Templates may start with front matter (see Page)
+	Markdown    bool     // Templates are markdown, rendered into a layout (see ResolveMarkdown)
+	OutputExt   string   // Extension to write output as, if not Extension
+	Optional    bool     // Directory may be missing
+	AutoSegment bool     // Translate html text even without {{ }} (see SegmentTemplate)
 }
 
 // QueueItem represents a single job to be queued, and ran as capacity allows.
@@ -46,12 +57,39 @@ type QueueItem struct {
 	PotFile  *po.File
 	Data     *TemplateData
 	PostInfo PostInfoType
+	Assets   *assets.Rewriter
+
+	// DependsOn lists the names (see Name) of jobs that must finish
+	// before this one may start.  BlockedBy is filled in with the
+	// last of those to finish.
+	DependsOn []string
+	BlockedBy string
+
+	// Profile records where the time went; filled in by the queue.
+	Profile *JobProfile
+}
+
+// Name identifies a job for dependencies and reporting;
+// ie "js/index.js@fr_FR".
+func (qi *QueueItem) Name() string {
+	return qi.PostInfo.Directory + "/" + qi.Filename + "@" + qi.PoFile.Locale
 }
 
 // QueueTracker is an object for managing QueueItem jobs.
+// Jobs run in dependency order, as many at a time as allowed.
 type QueueTracker struct {
 	Channel chan *QueueItem
 	WG      *sync.WaitGroup
+	Run     func(*QueueItem) // RunJob, unless testing
+
+	lock     sync.Mutex
+	workers  int
+	profiles []*JobProfile
+	byName   map[string]*QueueItem
+	done     map[string]bool
+	waiting  map[string][]*QueueItem // dependency name -> jobs waiting on it
+	pending  map[*QueueItem]int      // job -> count of unfinished dependencies
+	cpu      time.Duration           // processCPU when the queue started
 }
 
 // TemplateData is passed when adding the job to the queue.
@@ -65,59 +103,63 @@ type TemplateData struct {
 	Basename     string
 	AddLanguage  string
 	DirSignature string
+	Page         *Page            // This page's front matter
+	Pages        map[string]*Page // Front matter of every page of this type, by name
+	Profile      Profile          // The variant of the site being built
 }
 
-// ParsedCacheType provides properly mutex locked cache access to
-// the expanded (but untranslated) templates.
-type ParsedCacheType struct {
-	lock   sync.RWMutex
-	byname map[string]string
-}
-
-// ParsedCache holds the actual cache of expanded (but not translated) templates.
-var ParsedCache ParsedCacheType
-
-func init() {
-	ParsedCache.byname = make(map[string]string)
+// Profile is the variant of the site being built (see config.Record.Profiles);
+// templates can ask for [% .Profile.Name %] or [% .Profile.Vars.analytics %].
+type Profile struct {
+	Name string            // ie "beta"; "" if none was selected
+	Vars map[string]string // config.Record.Vars, with the profile's on top
 }
 
 // GrabContent grabs a file.  Takes into account the QueueItem variables
 // such as the iput directory path.  The file is cached for future requests.
+// Translatable strings in the file and its includes are added to the .pot.
 func GrabContent(qi *QueueItem) string {
-	topName := qi.RootDir + "/" + qi.Filename
-	// log.Printf("GrabContent(%s)  (%s)\n", qi.Filename, qi.PoFile.Language)
-
-	grab := func(fn string) string {
-		//		log.Printf("GrabContent(%s)  (%s) (fn=%s)\n", qi.Filename, qi.PoFile.Language, fn)
+	content, files := GrabIncludes(qi)
+	UpdatePotFiles(qi, files)
+	return content
+}
 
-		fullname := qi.RootDir + "/" + fn
-		c, err := fileutil.ReadFile(fullname)
+// GrabIncludes reads a file and resolves its PROCESS includes.  It returns
+// the assembled content, and the files it was assembled from (in order).
+// See ResolveIncludes.
+func GrabIncludes(qi *QueueItem) (string, []IncludedFile) {
+	// log.Printf("GrabContent(%s)  (%s)\n", qi.Filename, qi.PoFile.Language)
+	if qi.PostInfo.Markdown {
+		content, files, err := ResolveMarkdown(qi.RootDir, qi.Filename)
 		if err != nil {
-			log.Fatalf("tried to load %s (via %s): %s", fullname, topName, err)
+			log.Fatalf("%s: %v", qi.RootDir, err)
 		}
-		//		log.Printf("read %v (%v bytes)\n", fullname, len(c))
-
-		UpdatePot(qi, c, fn)
-
-		return c
+		return content, files
+	}
+	content, files, err := ResolveIncludes(qi.RootDir, qi.Filename)
+	if err != nil {
+		log.Fatalf("%s: %v", qi.RootDir, err)
+	}
+	if qi.PostInfo.FrontMatter {
+		_, _, content = SplitFrontMatter(content)
 	}
+	return content, files
+}
 
-	content := grab(qi.Filename)
-	// Do we see PROCESS lines?
-	for {
-		matches := rePROCESS.FindStringSubmatch(content)
-		if len(matches) == 0 {
-			break
-		}
-		if len(matches) < 2 {
-			log.Fatalf("I don't know what happened, but %s is interesting", matches[0])
-		}
-		wrapperString := matches[0]
-		insideName := matches[1]
-		newContent := grab(insideName)
-		content = strings.Replace(content, wrapperString, newContent, -1)
+// OutputName is the name to write a job's output as (before any locale
+// suffix): as mapped in the config, or as set in the page's front matter,
+// or simply the template name (with OutputExt, if set).
+func OutputName(qi *QueueItem) string {
+	if t, ok := qi.Config.Map[qi.Filename]; ok {
+		return t
 	}
-	return content
+	if qi.Data != nil && qi.Data.Page != nil && qi.Data.Page.Output != "" {
+		return qi.Data.Page.Output
+	}
+	if qi.PostInfo.OutputExt != "" {
+		return strings.TrimSuffix(qi.Filename, qi.PostInfo.Extension) + qi.PostInfo.OutputExt
+	}
+	return qi.Filename
 }
 
 // ProcessTemplate runs text.Template against the given text.
@@ -125,14 +167,16 @@ func GrabContent(qi *QueueItem) string {
 // are fewer than translations. And we prefer to do translations
 // without the template ugliness.
 func ProcessTemplate(qi *QueueItem, content string) string {
+	return processTemplate(qi, content, nil)
+}
+
+// processTemplate is ProcessTemplate, also noting what the expansion
+// depended on in deps, if not nil.
+func processTemplate(qi *QueueItem, content string, deps *Dependencies) string {
 	topName := qi.RootDir + "/" + qi.Filename
 
-	// Do we need any custom functions?
-	FuncMap := make(template.FuncMap)
-	FuncMap["EXAMPLE"] = func(name string) (string, error) {
-		//log.Printf("PROCESS: %v\n", name)
-		return "", nil
-	}
+	// Do we need any custom functions?  See funcs.go
+	FuncMap := TemplateFuncs(qi, deps)
 
 	// Parse the template.  Just looks for markers and implied commands.
 	root := template.New(qi.Filename).Delims(`[%`, `%]`).Funcs(FuncMap)
@@ -151,63 +195,97 @@ func ProcessTemplate(qi *QueueItem, content string) string {
 	return string(wr.Bytes())
 }
 
+// UpdatePot adds every {{ placeholder }} in content to the .pot file,
+// noting fn as where it was found.  Placeholders holding a template
+// action, ie {{[% .Page.Title %]}}, are skipped: what they expand to is
+// added by UpdatePotFiles.
 func UpdatePot(qi *QueueItem, content string, fn string) {
 	//	log.Printf("UpdatePot fn=%s\n", fn)
-	for {
-
-		matches := reTRANSLATE.FindStringSubmatch(content)
-		if len(matches) == 0 {
-			break
+	for _, insideName := range Tokenize(content).Placeholders() {
+		if strings.Contains(insideName, "[%") {
+			continue
 		}
-		if len(matches) < 2 {
-			log.Fatalf("I don't know what happened, but %s is interesting", matches[0])
-		}
-		wrapperString := matches[0]
-		insideName := matches[1]
-
 		//		log.Printf("UpdatePot inside=%s fn=%s escape=%v\n", insideName, fn, qi.EscapeQuotes)
-
 		qi.PotFile.Add(insideName, fn, qi.PostInfo.EscapeQuote)
+	}
+}
 
-		content = strings.Replace(content, wrapperString, insideName, -1)
-
+// UpdatePotFiles adds the strings from every file of a template (see
+// GrabIncludes), and from its front matter, to the .pot file.
+func UpdatePotFiles(qi *QueueItem, files []IncludedFile) {
+	for _, f := range files {
+		UpdatePot(qi, f.Content, f.Name)
+	}
+	if qi.Data != nil {
+		for _, s := range qi.Data.Page.Strings() {
+			qi.PotFile.Add(s, qi.Filename, qi.PostInfo.EscapeQuote)
+		}
 	}
 }
 
 // TranslateContent  looks for {{ text }} and replaces it with
 // either translated text, or the original text.
 func TranslateContent(qi *QueueItem, content string) string {
-	for {
+	return Tokenize(content).Translate(qi.PoFile, qi.PostInfo.EscapeQuote)
+}
 
-		matches := reTRANSLATE.FindStringSubmatch(content)
-		if len(matches) == 0 {
-			break
+// ResolveIntegrity replaces the markers left by the "integrity" template
+// function with the SRI digest of the asset, as built for this locale.
+func ResolveIntegrity(qi *QueueItem, content string) string {
+	topName := qi.RootDir + "/" + qi.Filename
+	return reINTEGRITY.ReplaceAllStringFunc(content, func(marker string) string {
+		name := reINTEGRITY.FindStringSubmatch(marker)[1]
+		if qi.Assets == nil {
+			log.Fatalf("%s: integrity %q: no asset manifest", topName, name)
 		}
-		if len(matches) < 2 {
-			log.Fatalf("I don't know what happened, but %s is interesting", matches[0])
+		digest, ok := qi.Assets.Manifest.LookupIntegrity(qi.Assets.Manifest.Logical(name), qi.PoFile.Locale)
+		if !ok {
+			log.Fatalf("%s: integrity %q: asset not built (yet?)", topName, name)
 		}
-		wrapperString := matches[0]
-		insideName := matches[1]
-
-		//	log.Printf("grabbing %v\n", insideName)
-		newContent := qi.PoFile.Translate(insideName, qi.PostInfo.EscapeQuote)
-
-		//	log.Printf("Replacing %s with %s\n", wrapperString, newContent)
+		return digest
+	})
+}
 
-		content = strings.Replace(content, wrapperString, newContent, -1)
+// RewriteReferences applies the asset rewrite rules to content, if this
+// type of file is expected to reference other assets.  compressed is true
+// when preparing the .gz variant.
+func RewriteReferences(qi *QueueItem, content string, compressed bool) string {
+	if !qi.PostInfo.References || qi.Assets == nil {
+		return content
+	}
+	return qi.Assets.Rewrite(qi.Filename, content, compressed, qi.PoFile.Locale)
+}
 
+// RecordAsset adds an output file (relative to OutputDir) to the asset
+// manifest, if this type of file is fingerprinted.  Files that were not
+// created (ie a post processor that does not gzip) are skipped.
+// The SRI digest is taken from the uncompressed file.
+func RecordAsset(qi *QueueItem, basename string, file string, compressed bool) {
+	if !qi.PostInfo.Fingerprint || qi.Assets == nil {
+		return
+	}
+	b, err := ioutil.ReadFile(qi.Config.Directories.OutputDir + "/" + file)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	qi.Assets.Manifest.AddContent("/"+basename, file, b)
+	if !compressed {
+		locale := ""
+		if qi.PostInfo.MultiLocale {
+			locale = qi.PoFile.Locale
+		}
+		qi.Assets.Manifest.AddIntegrity("/"+basename, locale, b)
 	}
-	return content
 }
 
 func ProcessContentFancy(qi *QueueItem, content string) {
 
 	tasks := qi.PostInfo.PostProcess
 
-	basename := qi.Filename
-	if t, ok := qi.Config.Map[qi.Filename]; ok {
-		basename = t
-	}
+	basename := OutputName(qi)
 
 	// Prepare the macros that we support for running external commands.
 	macros := make(map[string]string)
@@ -239,10 +317,13 @@ func ProcessContentFancy(qi *QueueItem, content string) {
 	outputfilename := qi.Config.Directories.OutputDir + "/" + macros["INPUT"]
 	os.MkdirAll(filepath.Dir(outputfilename), 0755)
 
+	done := qi.Phase("write")
+	content = RewriteReferences(qi, content, false)
 	err := ioutil.WriteFile(outputfilename, []byte(content), 0755)
 	if err != nil {
 		log.Fatal(err)
 	}
+	done()
 	// log.Printf("wrote %s etc (%v bytes)\n", outputfilename, len(content))
 
 	// Post processing defined from the config file, 3rd party tools
@@ -259,7 +340,9 @@ func ProcessContentFancy(qi *QueueItem, content string) {
 		c.Stdin = shellscript
 		c.Stderr = stderr
 		// log.Printf("About to run: %#v\n", runcmd)
+		done := qi.Command("sh: " + strings.Fields(runcmd + " ?")[0])
 		e := c.Run()
+		done(c.ProcessState)
 
 		// HACK HACK HACK ignore tidy exit code 1
 		if e != nil {
@@ -275,6 +358,10 @@ func ProcessContentFancy(qi *QueueItem, content string) {
 		}
 	}
 
+	done = qi.Phase("hash")
+	RecordAsset(qi, basename, macros["NAME"], false)
+	RecordAsset(qi, basename, macros["NAMEGZ"], true)
+	done()
 }
 
 func ProcessContent(qi *QueueItem, content string) {
@@ -286,35 +373,36 @@ func ProcessContent(qi *QueueItem, content string) {
 		return
 	}
 
-	basename := qi.Filename
-	if t, ok := qi.Config.Map[qi.Filename]; ok {
-		basename = t
-	}
+	basename := OutputName(qi)
 
 	// Otherwise, do writes directly, and do our own compression.
-	uncompressed := qi.Config.Directories.OutputDir + "/" + basename
-	compressed := qi.Config.Directories.OutputDir + "/" + basename + ".gz"
+	uncompressedName := basename
+	compressedName := basename + ".gz"
 	if qi.PostInfo.MultiLocale == true {
-		uncompressed = uncompressed + "." + qi.PoFile.Locale
-		compressed = compressed + "." + qi.PoFile.Locale
+		uncompressedName = uncompressedName + "." + qi.PoFile.Locale
+		compressedName = compressedName + "." + qi.PoFile.Locale
 	}
+	uncompressed := qi.Config.Directories.OutputDir + "/" + uncompressedName
+	compressed := qi.Config.Directories.OutputDir + "/" + compressedName
 
 	// Make sure the directory exists.
 	// We may need to keep track of this;
 	// do we really want to do this 1000+ times?
 	os.MkdirAll(filepath.Dir(uncompressed), 0755)
 
-	err := ioutil.WriteFile(uncompressed, []byte(content), 0644)
+	done := qi.Phase("write")
+	err := ioutil.WriteFile(uncompressed, []byte(RewriteReferences(qi, content, false)), 0644)
 	if err != nil {
 		log.Fatal(err)
 	}
 	// log.Printf("wrote %s etc (%v bytes)\n", outputfilename, len(content))
+	RecordAsset(qi, basename, uncompressedName, false)
+	done()
 
 	if qi.PostInfo.Compress {
-		if strings.HasSuffix(qi.Filename, ".html") {
-			content = strings.Replace(content, `src="/index.js`, `src="/index.js.gz`, -1)
-			content = strings.Replace(content, `href="/index.css`, `href="/index.css.gz`, -1)
-		}
+		done := qi.Phase("gzip")
+		defer done()
+		content = RewriteReferences(qi, content, true)
 
 		// Compress in memory
 		b := &bytes.Buffer{}
@@ -330,6 +418,7 @@ func ProcessContent(qi *QueueItem, content string) {
 		if err != nil {
 			log.Fatal(err)
 		}
+		RecordAsset(qi, basename, compressedName, true)
 	}
 
 }
@@ -339,23 +428,16 @@ func ProcessContent(qi *QueueItem, content string) {
 // by RunQueue.
 func RunJob(qi *QueueItem) {
 	// log.Printf("RunJob Filename=%s PoLang=%s\n", qi.Filename, qi.PoFile.Language)
-	readFilename := qi.RootDir + "/" + qi.Filename
-
-	var content string
-	ParsedCache.lock.Lock()
-	if c, ok := ParsedCache.byname[readFilename]; ok {
-		// log.Printf("cached: %s", readFilename)
-		content = c
-	} else {
-		//log.Printf("not cached: %s", readFilename)
-		content = GrabContent(qi)
-		content = ProcessTemplate(qi, content)
-		ParsedCache.byname[readFilename] = content
-	}
-	ParsedCache.lock.Unlock()
-
-	// TODO process translations
-	content = TranslateContent(qi, content)
+
+	done := qi.Phase("template")
+	segments := ParsedCache.Get(qi)
+	done()
+
+	done = qi.Phase("translate")
+	content := segments.Translate(qi.PoFile, qi.PostInfo.EscapeQuote)
+	content = ResolveIntegrity(qi, content)
+	done()
+
 	ProcessContent(qi, content)
 
 }
@@ -363,26 +445,159 @@ func RunJob(qi *QueueItem) {
 // RunQueue is a goroutine that listens to a channel for jobs.
 // If jobs are accepted, they are given to RunJob.
 func (qt *QueueTracker) RunQueue() {
+	qt.lock.Lock()
+	qt.workers++
+	worker := qt.workers
+	qt.lock.Unlock()
+
 	for {
 		job, ok := <-qt.Channel
 		if ok {
-			RunJob(job)  // Run the job.
-			qt.WG.Done() // Decrement WaitGroup counter
+			job.Profile = &JobProfile{
+				Name:   job.Name(),
+				File:   job.PostInfo.Directory + "/" + job.Filename,
+				Locale: job.PoFile.Locale,
+				Worker: worker,
+				Start:  time.Now(),
+			}
+			qt.Run(job)    // Run the job.
+			qt.finish(job) // Release anything waiting on it.
+			qt.WG.Done()   // Decrement WaitGroup counter
 		} else {
 			return
 		}
 	}
 }
 
-// Add a job to the queue.  Sends it to the channel.
+// Add a job to the queue.  If the job depends on others that have not
+// finished yet, it is held back until they have; otherwise it is sent
+// to the channel right away.
 func (qt *QueueTracker) Add(qi *QueueItem) {
-	qt.WG.Add(1)     // Increment the WaitGroup counter.
-	qt.Channel <- qi // Put the job in the queue.
+	name := qi.Name()
+	qt.WG.Add(1) // Increment the WaitGroup counter.
+
+	qt.lock.Lock()
+	if _, ok := qt.byName[name]; ok {
+		qt.lock.Unlock()
+		log.Fatalf("job %s queued twice", name)
+	}
+	qt.byName[name] = qi
+	for _, dep := range qi.DependsOn {
+		if !qt.done[dep] {
+			qt.waiting[dep] = append(qt.waiting[dep], qi)
+			qt.pending[qi]++
+		}
+	}
+	ready := qt.pending[qi] == 0
+	qt.lock.Unlock()
+
+	if ready {
+		qt.Channel <- qi // Put the job in the queue.
+	}
+}
+
+// finish marks a job as done, and queues any jobs that were only
+// waiting on it.
+func (qt *QueueTracker) finish(qi *QueueItem) {
+	name := qi.Name()
+	ready := []*QueueItem{}
+
+	qi.Profile.Duration = time.Since(qi.Profile.Start)
+	qi.Profile.BlockedBy = qi.BlockedBy
+
+	qt.lock.Lock()
+	qt.profiles = append(qt.profiles, qi.Profile)
+	qt.done[name] = true
+	for _, waiter := range qt.waiting[name] {
+		waiter.BlockedBy = name
+		qt.pending[waiter]--
+		if qt.pending[waiter] == 0 {
+			delete(qt.pending, waiter)
+			ready = append(ready, waiter)
+		}
+	}
+	delete(qt.waiting, name)
+	qt.lock.Unlock()
+
+	// Don't block this worker on a full channel; other workers
+	// may need to call finish() to make room.
+	for _, waiter := range ready {
+		go func(qi *QueueItem) { qt.Channel <- qi }(waiter)
+	}
+}
+
+// Check looks for jobs that can never run: either because they depend
+// on a job that was never queued, or because of a dependency cycle.
+// It should only be called once every job has been added.
+func (qt *QueueTracker) Check() error {
+	qt.lock.Lock()
+	defer qt.lock.Unlock()
+
+	blocked := []string{}
+	for qi := range qt.pending {
+		blocked = append(blocked, qi.Name())
+	}
+	sort.Strings(blocked)
+
+	// Missing dependencies
+	for _, name := range blocked {
+		for _, dep := range qt.byName[name].DependsOn {
+			if _, ok := qt.byName[dep]; !ok {
+				return fmt.Errorf("job %s depends on %s, which was never queued", name, dep)
+			}
+		}
+	}
+
+	// Cycles.  Only edges to jobs that have not finished matter.
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var stack []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			for i, s := range stack {
+				if s == name {
+					chain := append(append([]string{}, stack[i:]...), name)
+					return fmt.Errorf("dependency cycle: %s", strings.Join(chain, " -> "))
+				}
+			}
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, dep := range qt.byName[name].DependsOn {
+			if qt.done[dep] {
+				continue
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		return nil
+	}
+	for _, name := range blocked {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Wait will wait for all existing jobs to finish.
+// Jobs that can never run (see Check) are fatal.
 func (qt *QueueTracker) Wait() {
 	log.Printf("Waiting for queued jobs to finish\n")
+	if err := qt.Check(); err != nil {
+		log.Fatal(err)
+	}
 	qt.WG.Wait()
 }
 
@@ -392,6 +607,12 @@ func StartQueue(maxjobs int) *QueueTracker {
 	qt := &QueueTracker{}
 	qt.Channel = make(chan *QueueItem, 10000)
 	qt.WG = &sync.WaitGroup{}
+	qt.Run = RunJob
+	qt.byName = make(map[string]*QueueItem)
+	qt.done = make(map[string]bool)
+	qt.waiting = make(map[string][]*QueueItem)
+	qt.pending = make(map[*QueueItem]int)
+	qt.cpu = processCPU()
 
 	if maxjobs == 0 {
 		maxjobs = runtime.NumCPU()
@@ -0,0 +1,469 @@
+package job
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/falling-sky/fsbuilder/assets"
+	"github.com/falling-sky/fsbuilder/config"
+	"github.com/falling-sky/fsbuilder/fileutil"
+	"github.com/falling-sky/fsbuilder/gitinfo"
+	"github.com/falling-sky/fsbuilder/po"
+)
+
+func testItem(dir string, file string, deps ...string) *QueueItem {
+	return &QueueItem{
+		Filename:  file,
+		PoFile:    &po.File{Locale: "en_US"},
+		PostInfo:  PostInfoType{Directory: dir},
+		DependsOn: deps,
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	qt := StartQueue(4)
+	lock := sync.Mutex{}
+	finished := make(map[string]bool)
+	qt.Run = func(qi *QueueItem) {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, dep := range qi.DependsOn {
+			if !finished[dep] {
+				t.Errorf("%s ran before %s", qi.Name(), dep)
+			}
+		}
+		finished[qi.Name()] = true
+	}
+
+	// Dependents are added first, to make sure they are held back.
+	page := testItem("html", "index.html", "js/index.js@en_US", "css/index.css@en_US")
+	qt.Add(page)
+	qt.Add(testItem("js", "index.js", "css/index.css@en_US"))
+	qt.Add(testItem("css", "index.css"))
+	qt.Add(testItem("php", "comment.php"))
+	qt.Wait()
+
+	if len(finished) != 4 {
+		t.Errorf("expected 4 jobs to finish, got %v", finished)
+	}
+	if page.BlockedBy != "js/index.js@en_US" {
+		t.Errorf("page.BlockedBy=%v", page.BlockedBy)
+	}
+	if profiles := qt.Profiles(); len(profiles) != 4 {
+		t.Errorf("Profiles()=%v, expected 4", profiles)
+	}
+	if page.Profile == nil || page.Profile.BlockedBy != page.BlockedBy {
+		t.Errorf("page.Profile=%#v", page.Profile)
+	}
+	if summary := qt.Summary(3); !strings.HasPrefix(summary, "4 jobs;") {
+		t.Errorf("Summary()=%v", summary)
+	}
+}
+
+func TestQueueCheck(t *testing.T) {
+	var table = []struct {
+		items []*QueueItem
+		err   string
+	}{
+		{
+			[]*QueueItem{testItem("html", "a.html", "js/missing.js@en_US")},
+			"html/a.html@en_US depends on js/missing.js@en_US, which was never queued",
+		},
+		{
+			[]*QueueItem{
+				testItem("html", "a.html", "html/b.html@en_US"),
+				testItem("html", "b.html", "html/c.html@en_US"),
+				testItem("html", "c.html", "html/a.html@en_US"),
+			},
+			"dependency cycle: html/a.html@en_US -> html/b.html@en_US -> html/c.html@en_US -> html/a.html@en_US",
+		},
+	}
+	for _, tt := range table {
+		qt := StartQueue(1)
+		qt.Run = func(qi *QueueItem) {}
+		for _, qi := range tt.items {
+			qt.Add(qi)
+		}
+		err := qt.Check()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Check()=%v, expected %q", err, tt.err)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	qt := &QueueTracker{}
+	for i, file := range []string{"html/index.html", "html/faq.html"} {
+		qt.profiles = append(qt.profiles, &JobProfile{
+			File:     file,
+			Locale:   "fr_FR",
+			Start:    start,
+			Duration: time.Duration(i+1) * time.Second,
+			Spans:    []Span{{Phase: "template", Start: start, Duration: time.Second, CPU: 250 * time.Millisecond}},
+		})
+	}
+	p := &JobProfile{}
+	done := p.Command("sh: loop")
+	c := exec.Command("/bin/sh", "-c", "i=0; while [ $i -lt 20000 ]; do i=$((i+1)); done")
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	done(c.ProcessState)
+	if len(p.Spans) != 1 || p.Spans[0].CPU <= 0 {
+		t.Errorf("Command recorded %+v, expected the CPU time of the command", p.Spans)
+	}
+
+	s := qt.Summary(1)
+	for _, want := range []string{
+		"2 jobs; 3s job time (sum of jobs), 2s wall clock (1.5x parallel)\nCPU: ",
+		" in fsbuilder, 500ms in post processors\n",
+		"Slowest files:\n            2s      1  html/faq.html\n",
+		"Slowest locales:\n            3s      2  fr_FR\n",
+		"Slowest phases:\n            2s      2  template\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Summary is missing %q:\n%s", want, s)
+		}
+	}
+}
+
+func TestSegmentTemplate(t *testing.T) {
+	in := `<p>Built on [% .GitInfo.Date %] for prod</p><p>[% if .Page %]Hello world[% end %]</p><img alt=" [% .Basename %] "><img alt=" A logo ">`
+	out, found := SegmentTemplate(in)
+	expected := `<p>Built on [% .GitInfo.Date %] for prod</p><p>[% if .Page %]{{Hello world}}[% end %]</p><img alt=" [% .Basename %] "><img alt=" {{A logo}} ">`
+	if out != expected || strings.Join(found, "|") != "Hello world|A logo" {
+		t.Errorf("SegmentTemplate=%q %q\nexpected %q", out, found, expected)
+	}
+}
+
+func TestParsedCache(t *testing.T) {
+	dir := t.TempDir()
+	write := func(fn string, content string) {
+		if err := ioutil.WriteFile(dir+"/"+fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("page.html", `[% $x := "a" %]<h1>{{Hello}}</h1>[% PROCESS "footer.inc" %]`)
+	write("footer.inc", `<p>{{Footer}}</p>`)
+
+	pot := &po.File{ByID: make(po.MapStringRecord)}
+	item := func(locale string) *QueueItem {
+		qi := testItem("html", "page.html")
+		qi.RootDir = dir
+		qi.PoFile = &po.File{Locale: locale}
+		qi.PotFile = pot
+		qi.Data = &TemplateData{Basename: "page"}
+		return qi
+	}
+
+	first := ParsedCache.Get(item("en_US")).String()
+	second := ParsedCache.Get(item("fr_FR")).String()
+	if first != "<h1>{{Hello}}</h1><p>{{Footer}}</p>" || second != first {
+		t.Errorf("Get()=%q then %q", first, second)
+	}
+	if _, ok := pot.ByID["Footer"]; !ok {
+		t.Errorf("included strings were not added to the .pot")
+	}
+
+	// A changed include is a different cache entry.
+	write("footer.inc", `<p>{{Changed}}</p>`)
+	fileutil.ResetCache()
+	if third := ParsedCache.Get(item("en_US")).String(); third != "<h1>{{Hello}}</h1><p>{{Changed}}</p>" {
+		t.Errorf("Get() after change=%q", third)
+	}
+}
+
+func TestUpdatePotFiles(t *testing.T) {
+	pot := &po.File{ByID: make(po.MapStringRecord)}
+	qi := testItem("html", "faq.html")
+	qi.PotFile = pot
+	qi.Data = &TemplateData{Page: &Page{Title: "Questions"}}
+	UpdatePotFiles(qi, []IncludedFile{{Name: "faq.html", Content: "<title>{{[% .Page.Title %]}}</title><p>{{Answers}}</p>"}})
+
+	got := []string{}
+	for msgid := range pot.ByID {
+		got = append(got, msgid)
+	}
+	sort.Strings(got)
+	if strings.Join(got, "|") != "Answers|Questions" {
+		t.Errorf("UpdatePotFiles added %q, expected Answers and Questions", got)
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	f := &po.File{Locale: "fr_FR", ByID: make(po.MapStringRecord)}
+	f.ByID["Hello"] = &po.Record{MsgID: "Hello", MsgStr: "Bonjour {{Hello}}"}
+	f.ByID["It's"] = &po.Record{MsgID: "It's", MsgStr: "C'est"}
+
+	var table = []struct {
+		in     string
+		escape bool
+		out    string
+	}{
+		{"a {{Hello}} b {{ Hello\n}}", false, "a Bonjour {{Hello}} b Bonjour {{Hello}}"},
+		{"x = '{{It's}}';", true, `x = 'C\'est';`},
+		{"{{locale}} {{unknown}} {{unterminated", false, "fr_FR unknown {{unterminated"},
+		{"no placeholders", false, "no placeholders"},
+	}
+	for _, tt := range table {
+		found := Tokenize(tt.in).Translate(f, tt.escape)
+		if found != tt.out {
+			t.Errorf("Translate(%q)=%q, expected %q", tt.in, found, tt.out)
+		}
+		if back := Tokenize(tt.in).String(); back != tt.in {
+			t.Errorf("Tokenize(%q).String()=%q", tt.in, back)
+		}
+	}
+}
+
+func TestResolveIncludes(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"page.html":     `[% $page := "home" %][% PROCESS "header.inc" title="About \"us\"" %]|[% $page %]|[% template "nav" . %]`,
+		"header.inc":    `<title>[% $title %]/[% $page %]</title>[% PROCESS "macros.inc" %]`,
+		"macros.inc":    `[% define "nav" %]<nav>[% .Basename %]</nav>[% end %]`,
+		"loop.html":     `[% PROCESS "a.inc" %]`,
+		"a.inc":         `[% PROCESS "b.inc" %]`,
+		"b.inc":         `[% PROCESS "a.inc" %]`,
+		"missing.html":  `[% PROCESS "sub/local.inc" %][% PROCESS "nope.inc" %]`,
+		"sub/page.html": `[% PROCESS "local.inc" %][% PROCESS "macros.inc" %]`,
+		"sub/local.inc": `local`,
+	}
+	os.Mkdir(dir+"/sub", 0755)
+	for fn, content := range files {
+		if err := ioutil.WriteFile(dir+"/"+fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content, included, err := ResolveIncludes(dir, "page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(included) != 3 {
+		t.Errorf("included=%v", included)
+	}
+	qi := testItem("html", "page.html")
+	qi.RootDir = dir
+	qi.Data = &TemplateData{Basename: "page"}
+	if found := ProcessTemplate(qi, content); found != `<title>About "us"/home</title>|home|<nav>page</nav>` {
+		t.Errorf("ProcessTemplate(page.html)=%q", found)
+	}
+
+	if _, _, err := ResolveIncludes(dir, "loop.html"); err == nil || err.Error() != "include loop.html -> a.inc -> b.inc -> a.inc: include cycle" {
+		t.Errorf("ResolveIncludes(loop.html) error=%v", err)
+	}
+	if _, _, err := ResolveIncludes(dir, "missing.html"); err == nil || !strings.HasPrefix(err.Error(), "include missing.html -> nope.inc: ") {
+		t.Errorf("ResolveIncludes(missing.html) error=%v", err)
+	}
+	if content, _, err := ResolveIncludes(dir, "sub/page.html"); err != nil || !strings.HasPrefix(content, "local[% define") {
+		t.Errorf("ResolveIncludes(sub/page.html)=%q, %v", content, err)
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir+"/snippet.svg", []byte("<svg/>"), 0644)
+	os.Mkdir(dir+"/svg", 0755)
+	ioutil.WriteFile(dir+"/svg/logo.svg", []byte(`<svg id="logo"/>`), 0644)
+	os.Setenv("FSBUILDER_TEST_OK", "yes")
+	os.Setenv("FSBUILDER_TEST_NO", "secret")
+
+	qi := testItem("html", "page.html")
+	qi.RootDir = dir
+	qi.Config = &config.Record{}
+	qi.Config.Options.Env = []string{"FSBUILDER_TEST_OK"}
+	qi.Config.Directories.TemplateDir = dir
+	qi.Data = &TemplateData{
+		Basename: "page",
+		GitInfo:  &gitinfo.GitInfo{Date: "Mon Oct 19 15:13:52 2026 +0000"},
+	}
+
+	var table = []struct {
+		in  string
+		out string
+	}{
+		{`[% upper "abc" %] [% "a-b-c" | replace "-" "+" %] [% split "," "x,y" | join "/" %]`, `ABC a+b+c x/y`},
+		{`[% default "none" "" %] [% "index.html" | trimSuffix ".html" %]`, `none index`},
+		{`[% include "snippet.svg" %]`, `<svg/>`},
+		{`[% readFile "svg/logo.svg" %]`, `<svg id="logo"/>`},
+		{`[% json .Basename %] [% json (split "," "a,b") %]`, `"page" ["a","b"]`},
+		{`[% date "2006-01-02" .GitInfo.Date %]`, `2026-10-19`},
+		{`[% env "FSBUILDER_TEST_OK" %]`, `yes`},
+		{`<html lang="[% lang %]" dir="[% dir %]">`, `<html lang="{{lang}}" dir="{{dir}}">`},
+	}
+	for _, tt := range table {
+		if found := ProcessTemplate(qi, tt.in); found != tt.out {
+			t.Errorf("ProcessTemplate(%q)=%q, expected %q", tt.in, found, tt.out)
+		}
+	}
+
+	funcs := TemplateFuncs(qi, nil)
+	if _, err := funcs["env"].(func(string) (string, error))("FSBUILDER_TEST_NO"); err == nil {
+		t.Errorf("env should refuse variables not in Options.Env")
+	}
+	if _, err := funcs["include"].(func(string) (string, error))("../../etc/passwd"); err == nil {
+		t.Errorf("include should refuse to climb out of RootDir")
+	}
+	for _, name := range []string{"../snippet.svg", "svg/../../snippet.svg", "/etc/passwd"} {
+		if _, err := funcs["readFile"].(func(string) (string, error))(name); err == nil {
+			t.Errorf("readFile %s should refuse to climb out of TemplateDir", name)
+		}
+	}
+
+	// Hashed names of built assets are only final once their jobs are done.
+	qi = testItem("js", "index.js")
+	qi.Assets = assets.NewRewriter(nil)
+	qi.Assets.Built[".css"] = "css"
+	qi.Assets.Built[".js"] = "js"
+	funcs = TemplateFuncs(qi, nil)
+	for _, name := range []string{"/site.css", "/other.js"} {
+		if _, err := funcs["asset"].(func(string) (string, error))(name); err == nil {
+			t.Errorf("asset %s should be refused in js templates, without After: css, js", name)
+		}
+	}
+	if _, err := funcs["asset"].(func(string) (string, error))("/images/logo.png"); err != nil {
+		t.Errorf("asset /images/logo.png: %v", err)
+	}
+	qi.PostInfo.After = []string{"css"}
+	if _, err := funcs["integrity"].(func(string) (string, error))("/site.css"); err != nil {
+		t.Errorf("integrity /site.css, with After: css: %v", err)
+	}
+}
+
+func TestParsePage(t *testing.T) {
+	var table = []struct {
+		in      string
+		title   string
+		sitemap bool
+		rest    string
+		strings int
+	}{
+		{"<p>plain</p>", "", true, "<p>plain</p>", 0},
+		{"---\ntitle: FAQ\nsitemap: false\n---\n<p>body</p>", "FAQ", false, "<p>body</p>", 1},
+		{"---\r\ntitle: FAQ\r\ndescription: Why\r\n---\r\nbody", "FAQ", true, "body", 2},
+		{"---\ntitle: FAQ\nlede: Hello\ntranslate: [lede]\n---\nbody", "FAQ", true, "body", 2},
+		{"{\"title\": \"FAQ\", \"output\": \"faq.html\"}\nbody", "FAQ", true, "body", 1},
+		{"---\nnot closed\n", "", true, "---\nnot closed\n", 0},
+	}
+	for _, tt := range table {
+		p, rest, err := ParsePage("test.html", tt.in)
+		if err != nil {
+			t.Errorf("ParsePage(%q): %v", tt.in, err)
+			continue
+		}
+		if p.Title != tt.title || p.Sitemap != tt.sitemap || rest != tt.rest || len(p.Strings()) != tt.strings {
+			t.Errorf("ParsePage(%q)=%+v %q, expected title %q sitemap %v rest %q and %d strings", tt.in, p, rest, tt.title, tt.sitemap, tt.rest, tt.strings)
+		}
+	}
+
+	for _, in := range []string{"---\ntitle: [a, b]\n---\n", "---\nsitemap: maybe\n---\n", "---\n: : :\n---\n"} {
+		if _, _, err := ParsePage("test.html", in); err == nil {
+			t.Errorf("ParsePage(%q) should have failed", in)
+		}
+	}
+}
+
+func TestResolveMarkdown(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir+"/layout.inc", []byte(`<title>{{[% .Page.Title %]}}</title>[% template "content" . %]`), 0644)
+	ioutil.WriteFile(dir+"/faq.md", []byte("---\ntitle: FAQ\n---\n# Why IPv6?\n\nBecause *we are*\nout of addresses.\n\n- one\n- two\n\n![logo](/images/logo.png)\n\n    code\n"), 0644)
+	fileutil.ResetCache()
+
+	content, files, err := ResolveMarkdown(dir, "faq.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "faq.md" || files[1].Name != "layout.inc" {
+		t.Errorf("ResolveMarkdown files=%v", files)
+	}
+	expected := "<h1>{{Why IPv6?}}</h1>\n<p>{{Because <em>we are</em>\nout of addresses.}}</p>\n<ul>\n<li>{{one}}</li>\n<li>{{two}}</li>\n</ul>\n<p><img src=\"/images/logo.png\" alt=\"logo\"></p>\n<pre><code>code\n</code></pre>"
+	if !strings.Contains(content, expected) {
+		t.Errorf("ResolveMarkdown content=%q, expected it to contain %q", content, expected)
+	}
+
+	rendered, err := RenderMarkdown("Write [% .Page.Title %] as {{x}}}}\n\n    [%- end %]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "<p>{{Write &#91;% .Page.Title %&#93; as {&#123;x}&#125;}&#125;}}</p>\n<pre><code>&#91;%- end %&#93;\n</code></pre>\n"; rendered != expected {
+		t.Errorf("RenderMarkdown=%q, expected %q", rendered, expected)
+	}
+
+	qi := testItem("markdown", "faq.md")
+	qi.RootDir = dir
+	qi.PostInfo.Markdown = true
+	qi.Data = &TemplateData{Page: &Page{Title: "FAQ"}}
+	out := ProcessTemplate(qi, content)
+	if !strings.HasPrefix(out, "<title>{{FAQ}}</title><h1>{{Why IPv6?}}</h1>") {
+		t.Errorf("ProcessTemplate=%q", out)
+	}
+}
+
+func TestSegmentHTML(t *testing.T) {
+	var table = []struct {
+		in    string
+		out   string
+		found int
+	}{
+		{"<p>\n  Hello world\n</p>", "<p>\n  {{Hello world}}\n</p>", 1},
+		{`<img src="/a.png" alt="A logo"><input placeholder='Your name' title="">`, `<img src="/a.png" alt="{{A logo}}"><input placeholder='{{Your name}}' title="">`, 2},
+		{"<p>{{Already done}} <b>and this</b></p>", "<p>{{Already done}} <b>{{and this}}</b></p>", 1},
+		{"<script>var s = 'text';</script><code>ls -l</code><p>2026 &copy;</p>", "<script>var s = 'text';</script><code>ls -l</code><p>2026 &copy;</p>", 0},
+		{`<div translate="no"><div>Brand</div><img alt="Logo"></div><p>Text</p>`, `<div translate="no"><div>Brand</div><img alt="Logo"></div><p>{{Text}}</p>`, 1},
+		{"<p>Tom &amp; Jerry, {{lang}}</p><p>Tom &amp; Jerry</p>", "<p>Tom &amp; Jerry, {{lang}}</p><p>{{Tom &amp; Jerry}}</p>", 1},
+		{"<p>{{Because <em>we are</em> out of addresses}} today</p>", "<p>{{Because <em>we are</em> out of addresses}} {{today}}</p>", 1},
+		{`<p>{{See <img alt="the logo"> here}}</p>`, `<p>{{See <img alt="the logo"> here}}</p>`, 0},
+	}
+	for _, tt := range table {
+		out, found := SegmentHTML(tt.in)
+		if out != tt.out || len(found) != tt.found {
+			t.Errorf("SegmentHTML(%q)=%q %q, expected %q and %d strings", tt.in, out, found, tt.out, tt.found)
+		}
+	}
+}
+
+func TestLint(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(dir+"/html", 0755)
+	os.MkdirAll(dir+"/js", 0755)
+	ioutil.WriteFile(dir+"/html/index.html", []byte("[% $page := \"home\" %]\n<p>{{Hello world}}</p>\n<p>Not marked</p>\n[% PROCESS \"header.inc\" %]\n[% PROCESS \"missing.inc\" %]\n"), 0644)
+	ioutil.WriteFile(dir+"/html/header.inc", []byte("<h1>{{Hello\n  world}}</h1>\n"), 0644)
+	ioutil.WriteFile(dir+"/html/unused.inc", []byte("<p>{{Old}}</p>\n"), 0644)
+	ioutil.WriteFile(dir+"/html/broken.html", []byte("<p>{{Open</p>\n[% if .Page\n"), 0644)
+	ioutil.WriteFile(dir+"/js/index.js", []byte("function f() { if (x) { return \"{{Hello world}}\"; }}\n"), 0644)
+	os.MkdirAll(dir+"/jsraw", 0755)
+	ioutil.WriteFile(dir+"/jsraw/app.js", []byte("// {{Comment}}\nvar n = {{count}};\nvar s = 'a\\'b' + \"{{Hello world}}\";\n"), 0644)
+	fileutil.ResetCache()
+
+	types := []PostInfoType{
+		{Directory: "html", Extension: ".html", FrontMatter: true},
+		{Directory: "js", Extension: ".js", EscapeQuote: true},
+		{Directory: "jsraw", Extension: ".js"},
+		{Directory: "markdown", Extension: ".md", Optional: true, Markdown: true},
+	}
+	found := []string{}
+	for _, p := range Lint(dir, types) {
+		found = append(found, strings.TrimPrefix(p.String(), dir+"/"))
+	}
+	expected := []string{
+		`html/broken.html:1: {{ is not closed with }}`,
+		`html/broken.html:2: [% is not closed with %]`,
+		`html/broken.html:2: warning: text not marked for translation: "[% if .Page"`,
+		`html/header.inc:1: warning: msgid differs from ` + dir + `/html/index.html:2 only in whitespace: "Hello\n  world"`,
+		`html/index.html:3: warning: text not marked for translation: "Not marked"`,
+		`html/index.html:5: PROCESS "missing.inc": no such file`,
+		`html/unused.inc:1: warning: not included by any page`,
+		`jsraw/app.js:3: warning: {{ }} in a string; quotes in translations are not escaped (EscapeQuote)`,
+	}
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Lint found\n%s\nexpected\n%s", strings.Join(found, "\n"), strings.Join(expected, "\n"))
+	}
+}
@@ -0,0 +1,342 @@
+package job
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/falling-sky/fsbuilder/fileutil"
+	nethtml "golang.org/x/net/html"
+)
+
+// Problem is something Lint found wrong with a template.
+type Problem struct {
+	File    string
+	Line    int
+	Warning bool // Worth fixing, but the build would still work
+	Message string
+}
+
+// String formats a problem for editors and the like:
+// "file:line: message", or "file:line: warning: message".
+func (p Problem) String() string {
+	if p.Warning {
+		return fmt.Sprintf("%s:%d: warning: %s", p.File, p.Line, p.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+}
+
+// reDIRECTIVE matches a whole [% %] template directive.
+var reDIRECTIVE = regexp.MustCompile(`(?s)\[%.*?%\]`)
+
+// reSCRIPTATTR matches an event handler attribute inside a raw start tag.
+var reSCRIPTATTR = regexp.MustCompile(`\son\w+\s*=\s*("[^"]*"|'[^']*')`)
+
+// blank replaces everything but newlines with spaces, so that offsets
+// and line numbers stay the same.
+func blank(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' {
+			return r
+		}
+		return ' '
+	}, s)
+}
+
+// linter collects problems while checking templates.
+type linter struct {
+	problems []Problem
+	msgids   map[string][]Problem // canonical msgid -> where each spelling was seen
+}
+
+func (l *linter) add(file string, content string, offset int, warning bool, format string, args ...interface{}) {
+	l.problems = append(l.problems, Problem{
+		File:    file,
+		Line:    1 + strings.Count(content[:offset], "\n"),
+		Warning: warning,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// balance checks that every open marker has a matching close marker.
+// Stray close markers are only reported if strict; "}}" is common in
+// css and js.
+func (l *linter) balance(file string, content string, open string, close string, strict bool) {
+	pending := -1 // Offset of the unclosed open marker
+	for i := 0; i < len(content)-1; i++ {
+		switch content[i : i+2] {
+		case open:
+			if pending >= 0 {
+				l.add(file, content, pending, false, "%s is not closed with %s", open, close)
+			}
+			pending = i
+			i++
+		case close:
+			if pending < 0 {
+				if strict {
+					l.add(file, content, i, false, "%s without %s", close, open)
+				}
+			}
+			pending = -1
+			i++
+		}
+	}
+	if pending >= 0 {
+		l.add(file, content, pending, false, "%s is not closed with %s", open, close)
+	}
+}
+
+// includes checks that every PROCESS target exists, and returns the
+// files included.
+func (l *linter) includes(root string, file string, content string) []string {
+	found := []string{}
+	for _, m := range rePROCESS.FindAllStringSubmatchIndex(content, -1) {
+		target := locateInclude(root, file, content[m[2]:m[3]])
+		if _, err := os.Stat(root + "/" + target); err != nil {
+			l.add(root+"/"+file, content, m[0], false, "PROCESS %q: no such file", content[m[2]:m[3]])
+			continue
+		}
+		found = append(found, target)
+	}
+	return found
+}
+
+// placeholders notes every {{ msgid }}, to compare spellings later.
+func (l *linter) placeholders(file string, content string) {
+	offset := 0
+	for _, s := range Tokenize(content) {
+		if s.Placeholder {
+			canonical := strings.Join(strings.Fields(s.Text), " ")
+			p := Problem{File: file, Line: 1 + strings.Count(content[:offset], "\n"), Message: s.Text}
+			l.msgids[canonical] = append(l.msgids[canonical], p)
+			offset += len(s.Text) + 4
+			continue
+		}
+		offset += len(s.Text)
+	}
+}
+
+// html checks for visible text outside of {{ }}, and for {{ }} in
+// scripts, where quotes in a translation would break the code.
+func (l *linter) html(file string, content string) {
+	stripped := reDIRECTIVE.ReplaceAllStringFunc(content, blank)
+	_, units := segmentHTML(stripped)
+	for _, u := range units {
+		l.add(file, content, u.Offset, true, "text not marked for translation: %q", u.Text)
+	}
+
+	z := nethtml.NewTokenizer(strings.NewReader(stripped))
+	inScript := false
+	offset := 0
+	for {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			break
+		}
+		raw := string(z.Raw())
+		start := offset
+		offset += len(raw)
+		switch tt {
+		case nethtml.StartTagToken, nethtml.SelfClosingTagToken:
+			name, _ := z.TagName()
+			inScript = string(name) == "script" && tt == nethtml.StartTagToken
+			for _, m := range reSCRIPTATTR.FindAllStringIndex(raw, -1) {
+				if i := strings.Index(raw[m[0]:m[1]], "{{"); i >= 0 {
+					l.add(file, content, start+m[0]+i, true, "{{ }} in an event handler; quotes in translations are not escaped (EscapeQuote)")
+				}
+			}
+		case nethtml.EndTagToken:
+			inScript = false
+		case nethtml.TextToken:
+			if i := strings.Index(raw, "{{"); inScript && i >= 0 {
+				l.add(file, content, start+i, true, "{{ }} in a script; quotes in translations are not escaped (EscapeQuote)")
+			}
+		}
+	}
+}
+
+// js checks for {{ }} inside string literals, where quotes in a
+// translation would end the string; for js types without EscapeQuote.
+// Comments are skipped; regular expression literals are not recognized.
+func (l *linter) js(file string, content string) {
+	stripped := reDIRECTIVE.ReplaceAllStringFunc(content, blank)
+	quote := byte(0) // Inside a string literal, if set
+	reported := false
+	for i := 0; i < len(stripped); i++ {
+		c := stripped[i]
+		switch {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0 && c == '\n' && quote != '`':
+			quote = 0 // Unterminated; not our problem
+		case quote != 0:
+			if !reported && strings.HasPrefix(stripped[i:], "{{") {
+				l.add(file, content, i, true, "{{ }} in a string; quotes in translations are not escaped (EscapeQuote)")
+				reported = true
+			}
+		case strings.HasPrefix(stripped[i:], "//"):
+			if eol := strings.Index(stripped[i:], "\n"); eol >= 0 {
+				i += eol
+			} else {
+				i = len(stripped)
+			}
+		case strings.HasPrefix(stripped[i:], "/*"):
+			if end := strings.Index(stripped[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(stripped)
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote, reported = c, false
+		}
+	}
+}
+
+// Lint checks the templates of every post type, without building them.
+// Problems are returned sorted by file and line.
+func Lint(templateDir string, types []PostInfoType) []Problem {
+	l := &linter{msgids: make(map[string][]Problem)}
+
+	// Several types may share a directory (ie apache).
+	byDir := make(map[string][]PostInfoType)
+	dirs := []string{}
+	for _, tt := range types {
+		if byDir[tt.Directory] == nil {
+			dirs = append(dirs, tt.Directory)
+		}
+		byDir[tt.Directory] = append(byDir[tt.Directory], tt)
+	}
+
+	for _, dir := range dirs {
+		root := templateDir + "/" + dir
+		files, err := fileutil.FilesInDirNotRecursive(root)
+		if err != nil {
+			if os.IsNotExist(err) && byDir[dir][0].Optional {
+				continue
+			}
+			l.problems = append(l.problems, Problem{File: root, Message: err.Error()})
+			continue
+		}
+		sort.Strings(files)
+
+		// Which type (if any) each file is a page of.
+		pageType := make(map[string]*PostInfoType)
+		for _, file := range files {
+			for i, tt := range byDir[dir] {
+				if strings.HasSuffix(file, tt.Extension) {
+					pageType[file] = &byDir[dir][i]
+				}
+			}
+		}
+
+		included := make(map[string][]string)
+		for _, file := range files {
+			if !strings.HasSuffix(file, ".inc") && pageType[file] == nil {
+				continue
+			}
+			tt := pageType[file]
+			if tt == nil {
+				// Includes are checked as if they were pages of the directory.
+				tt = &byDir[dir][0]
+			}
+			name := root + "/" + file
+			content, err := fileutil.ReadFile(name)
+			if err != nil {
+				l.problems = append(l.problems, Problem{File: name, Message: err.Error()})
+				continue
+			}
+			isHTML := tt.Extension == ".html" || tt.OutputExt == ".html"
+			isMarkdown := tt.Markdown && pageType[file] != nil
+
+			var page *Page
+			if tt.FrontMatter && pageType[file] != nil {
+				if page, _, err = ParsePage(file, content); err != nil {
+					l.add(name, content, 0, false, "%v", err)
+				}
+				_, _, rest := SplitFrontMatter(content)
+				content = blank(content[:len(content)-len(rest)]) + rest
+			}
+
+			l.balance(name, content, "[%", "%]", true)
+			if !isMarkdown {
+				l.balance(name, content, "{{", "}}", isHTML)
+				l.placeholders(name, content)
+			}
+			included[file] = l.includes(root, file, content)
+			if isHTML && !isMarkdown {
+				l.html(name, content)
+			}
+			if tt.Extension == ".js" && !tt.EscapeQuote {
+				l.js(name, content)
+			}
+			if isMarkdown {
+				layout := DefaultLayout
+				if page != nil && page.Layout != "" {
+					layout = page.Layout
+				}
+				layout = locateInclude(root, file, layout)
+				if _, err := os.Stat(root + "/" + layout); err != nil {
+					l.add(name, content, 0, false, "layout %q: no such file", layout)
+				}
+				included[file] = append(included[file], layout)
+			}
+		}
+
+		// Anything not reachable from a page is unused.
+		used := make(map[string]bool)
+		var visit func(file string)
+		visit = func(file string) {
+			for _, inc := range included[file] {
+				if !used[inc] {
+					used[inc] = true
+					visit(inc)
+				}
+			}
+		}
+		for _, file := range files {
+			if pageType[file] != nil {
+				visit(file)
+			}
+		}
+		for _, file := range files {
+			if strings.HasSuffix(file, ".inc") && !used[file] {
+				l.problems = append(l.problems, Problem{File: root + "/" + file, Line: 1, Warning: true, Message: "not included by any page"})
+			}
+		}
+	}
+
+	// Spellings of a msgid that differ only in whitespace end up as one
+	// string in the .pot file; which is probably not what was intended.
+	// Those that differ from the most common spelling are reported.
+	for _, seen := range l.msgids {
+		count := make(map[string]int)
+		for _, p := range seen {
+			count[p.Message]++
+		}
+		first := seen[0]
+		for _, p := range seen {
+			if count[p.Message] > count[first.Message] {
+				first = p
+			}
+		}
+		for _, p := range seen {
+			if p.Message != first.Message {
+				p.Warning = true
+				p.Message = fmt.Sprintf("msgid differs from %s:%d only in whitespace: %q", first.File, first.Line, p.Message)
+				l.problems = append(l.problems, p)
+			}
+		}
+	}
+
+	sort.SliceStable(l.problems, func(i, j int) bool {
+		if l.problems[i].File != l.problems[j].File {
+			return l.problems[i].File < l.problems[j].File
+		}
+		return l.problems[i].Line < l.problems[j].Line
+	})
+	return l.problems
+}
@@ -0,0 +1,174 @@
+package job
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/falling-sky/fsbuilder/fileutil"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/util"
+)
+
+// DefaultLayout is the layout used by markdown pages whose front matter
+// does not name one.
+const DefaultLayout = "layout.inc"
+
+// markOpen and markClose stand in for the {{ }} that segmentRenderer
+// adds, until the rendered page has been escaped (see RenderMarkdown).
+// goldmark never writes a NUL.
+const (
+	markOpen  = "\x00("
+	markClose = ")\x00"
+)
+
+// markdownEscaper keeps markers written in the markdown itself from being
+// taken as template directives, or as the end of a msgid.
+var markdownEscaper = strings.NewReplacer("[%", "&#91;%", "%]", "%&#93;", "{{", "{&#123;", "}}", "}&#125;")
+
+// segmentRenderer renders paragraphs, headings and (tight) list items
+// with their content wrapped in {{ }}, so that each becomes a msgid.
+// Everything else is left to goldmark's html renderer.
+type segmentRenderer struct{}
+
+func (r *segmentRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindParagraph, r.renderParagraph)
+	reg.Register(ast.KindTextBlock, r.renderTextBlock)
+	reg.Register(ast.KindHeading, r.renderHeading)
+}
+
+// hasText reports whether a block has any visible text worth translating;
+// ie not just an image.
+func hasText(n ast.Node, source []byte) bool {
+	found := false
+	ast.Walk(n, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+		if _, ok := c.(*ast.Image); ok {
+			return ast.WalkSkipChildren, nil
+		}
+		if t, ok := c.(*ast.Text); ok && entering && len(bytes.TrimSpace(t.Segment.Value(source))) > 0 {
+			found = true
+			return ast.WalkStop, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return found
+}
+
+func (r *segmentRenderer) renderParagraph(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		w.WriteString("<p")
+		if n.Attributes() != nil {
+			html.RenderAttributes(w, n, html.ParagraphAttributeFilter)
+		}
+		w.WriteString(">")
+		if hasText(n, source) {
+			w.WriteString(markOpen)
+		}
+	} else {
+		if hasText(n, source) {
+			w.WriteString(markClose)
+		}
+		w.WriteString("</p>\n")
+	}
+	return ast.WalkContinue, nil
+}
+
+func (r *segmentRenderer) renderTextBlock(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		if hasText(n, source) {
+			w.WriteString(markOpen)
+		}
+	} else {
+		if hasText(n, source) {
+			w.WriteString(markClose)
+		}
+		if n.NextSibling() != nil && n.FirstChild() != nil {
+			w.WriteByte('\n')
+		}
+	}
+	return ast.WalkContinue, nil
+}
+
+func (r *segmentRenderer) renderHeading(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n := node.(*ast.Heading)
+	if entering {
+		w.WriteString("<h")
+		w.WriteByte("0123456"[n.Level])
+		if n.Attributes() != nil {
+			html.RenderAttributes(w, node, html.HeadingAttributeFilter)
+		}
+		w.WriteByte('>')
+		if hasText(n, source) {
+			w.WriteString(markOpen)
+		}
+	} else {
+		if hasText(n, source) {
+			w.WriteString(markClose)
+		}
+		w.WriteString("</h")
+		w.WriteByte("0123456"[n.Level])
+		w.WriteString(">\n")
+	}
+	return ast.WalkContinue, nil
+}
+
+// markdown renders CommonMark, allowing raw html, with each paragraph,
+// heading and list item wrapped in {{ }}.
+var markdown = goldmark.New(
+	goldmark.WithRendererOptions(
+		html.WithUnsafe(),
+		renderer.WithNodeRenderers(util.Prioritized(&segmentRenderer{}, 100)),
+	),
+)
+
+// RenderMarkdown converts markdown to html, ready for translation:
+// every paragraph, heading and list item becomes a {{ msgid }}.
+// Any [% %] or {{ }} in the markdown is written as html entities, so
+// that it shows as written.
+func RenderMarkdown(source string) (string, error) {
+	b := &bytes.Buffer{}
+	if err := markdown.Convert([]byte(source), b); err != nil {
+		return "", err
+	}
+	rendered := markdownEscaper.Replace(b.String())
+	return strings.NewReplacer(markOpen, "{{", markClose, "}}").Replace(rendered), nil
+}
+
+// ResolveMarkdown reads root/name (a markdown page, possibly with front
+// matter), and places it inside its layout.  The rendered page is defined
+// as the "content" template, for the layout to use with
+//
+//	[% template "content" . %]
+//
+// Like ResolveIncludes, it returns the files the page was assembled from;
+// the markdown file is listed with its rendered html, so that the msgids
+// are found in it.
+func ResolveMarkdown(root string, name string) (string, []IncludedFile, error) {
+	source, err := fileutil.ReadFile(root + "/" + name)
+	if err != nil {
+		return "", nil, &IncludeError{Chain: []string{name}, Err: err}
+	}
+	page, body, err := ParsePage(name, source)
+	if err != nil {
+		return "", nil, err
+	}
+	rendered, err := RenderMarkdown(body)
+	if err != nil {
+		return "", nil, &IncludeError{Chain: []string{name}, Err: err}
+	}
+
+	layout := DefaultLayout
+	if page.Layout != "" {
+		layout = page.Layout
+	}
+	content, files, err := ResolveIncludes(root, locateInclude(root, name, layout))
+	if err != nil {
+		return "", nil, err
+	}
+
+	files = append([]IncludedFile{{Name: name, Content: rendered}}, files...)
+	content = content + `[% define "content" %]` + strings.TrimSuffix(rendered, "\n") + `[% end %]`
+	return content, files, nil
+}
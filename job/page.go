@@ -0,0 +1,179 @@
+package job
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/falling-sky/fsbuilder/fileutil"
+	"gopkg.in/yaml.v3"
+)
+
+// Page is the front matter of a page template.  It is optional; it may be
+// YAML between "---" lines, or a JSON object, at the very top of the file:
+//
+//	---
+//	title: Frequently Asked Questions
+//	description: Why should I care about IPv6?
+//	sitemap: false
+//	---
+//
+// Templates see this as .Page (ie .Page.Title, or .Page.Vars.whatever).
+// Title, Description and any keys named in "translate" are added to the
+// .pot file; use them as {{[% .Page.Title %]}} to have them translated.
+type Page struct {
+	Name        string                 // Template file name, ie faq.html
+	Title       string                 // title
+	Description string                 // description
+	Sitemap     bool                   // sitemap; include in sitemap.xml (default true)
+	Output      string                 // output; output name, instead of Name
+	Layout      string                 // layout; for markdown pages (see ResolveMarkdown)
+	Translate   []string               // translate; other keys whose values are translatable
+	Vars        map[string]interface{} // Every key, as written
+}
+
+// SplitFrontMatter separates the front matter (if any) from the rest of
+// a template.  The front matter is returned without its "---" markers.
+func SplitFrontMatter(content string) (front string, format string, rest string) {
+	switch {
+	case strings.HasPrefix(content, "---\n") || strings.HasPrefix(content, "---\r\n"):
+		body := content[strings.Index(content, "\n")+1:]
+		for offset := 0; offset < len(body); {
+			eol := strings.Index(body[offset:], "\n")
+			line := body[offset:]
+			if eol >= 0 {
+				line = body[offset : offset+eol]
+			}
+			if strings.TrimRight(line, "\r") == "---" {
+				if eol < 0 {
+					return body[:offset], "yaml", ""
+				}
+				return body[:offset], "yaml", body[offset+eol+1:]
+			}
+			if eol < 0 {
+				break
+			}
+			offset += eol + 1
+		}
+	case strings.HasPrefix(content, "{"):
+		d := json.NewDecoder(strings.NewReader(content))
+		var raw json.RawMessage
+		if err := d.Decode(&raw); err == nil {
+			rest := content[d.InputOffset():]
+			rest = strings.TrimPrefix(strings.TrimPrefix(rest, "\r"), "\n")
+			return string(raw), "json", rest
+		}
+	}
+	return "", "", content
+}
+
+// ParsePage parses the front matter of a template; name is used for
+// error messages and as the default Name.  Templates without front matter
+// return a Page with just the defaults.
+func ParsePage(name string, content string) (*Page, string, error) {
+	p := &Page{Name: name, Sitemap: true, Vars: make(map[string]interface{})}
+	front, format, rest := SplitFrontMatter(content)
+
+	var err error
+	switch format {
+	case "yaml":
+		err = yaml.Unmarshal([]byte(front), &p.Vars)
+	case "json":
+		err = json.Unmarshal([]byte(front), &p.Vars)
+	}
+	if err != nil {
+		return nil, content, fmt.Errorf("%s: front matter: %v", name, err)
+	}
+	if p.Vars == nil {
+		p.Vars = make(map[string]interface{})
+	}
+
+	str := func(key string) (string, error) {
+		v, ok := p.Vars[key]
+		if !ok {
+			return "", nil
+		}
+		s, ok := v.(string)
+		if !ok {
+			return "", fmt.Errorf("%s: front matter: %s should be a string, not %T", name, key, v)
+		}
+		return s, nil
+	}
+	if p.Title, err = str("title"); err != nil {
+		return nil, content, err
+	}
+	if p.Description, err = str("description"); err != nil {
+		return nil, content, err
+	}
+	if p.Output, err = str("output"); err != nil {
+		return nil, content, err
+	}
+	if p.Layout, err = str("layout"); err != nil {
+		return nil, content, err
+	}
+	if v, ok := p.Vars["sitemap"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, content, fmt.Errorf("%s: front matter: sitemap should be true or false, not %T", name, v)
+		}
+		p.Sitemap = b
+	}
+	if v, ok := p.Vars["translate"]; ok {
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, content, fmt.Errorf("%s: front matter: translate should be a list of keys", name)
+		}
+		for _, item := range list {
+			p.Translate = append(p.Translate, fmt.Sprint(item))
+		}
+	}
+	return p, rest, nil
+}
+
+// LoadPage reads a template and parses its front matter.
+func LoadPage(rootDir string, name string) (*Page, error) {
+	content, err := fileutil.ReadFile(rootDir + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	p, _, err := ParsePage(name, content)
+	return p, err
+}
+
+// Strings returns the translatable front matter values.
+func (p *Page) Strings() []string {
+	if p == nil {
+		return nil
+	}
+	ret := []string{}
+	for _, s := range []string{p.Title, p.Description} {
+		if s != "" {
+			ret = append(ret, s)
+		}
+	}
+	for _, key := range p.Translate {
+		if s, ok := p.Vars[key].(string); ok && s != "" {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// Key summarizes the page, for use in cache keys.
+func (p *Page) Key() string {
+	if p == nil {
+		return ""
+	}
+	b := &bytes.Buffer{}
+	keys := []string{}
+	for k := range p.Vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s=%#v\n", k, p.Vars[k])
+	}
+	return b.String()
+}
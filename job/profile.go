@@ -0,0 +1,238 @@
+package job
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Span is the time spent in a single phase of a job;
+// ie "template", "translate", "gzip" or a post processor command.
+type Span struct {
+	Phase    string
+	Start    time.Time
+	Duration time.Duration
+	CPU      time.Duration // Used by a post processor command (see Command)
+}
+
+// processCPU is the CPU time (user and system) used by fsbuilder itself
+// so far; not by the commands it runs.
+func processCPU() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// JobProfile records where a single job spent its time.
+type JobProfile struct {
+	Name      string
+	File      string // ie html/index.html
+	Locale    string
+	Worker    int
+	Start     time.Time
+	Duration  time.Duration
+	BlockedBy string
+	Spans     []Span
+	lock      sync.Mutex
+}
+
+// Phase starts timing a phase of this job; call the returned
+// function when the phase is done.  Safe to call on a nil profile.
+func (p *JobProfile) Phase(phase string) func() {
+	if p == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		p.lock.Lock()
+		p.Spans = append(p.Spans, Span{Phase: phase, Start: start, Duration: time.Since(start)})
+		p.lock.Unlock()
+	}
+}
+
+// Command times a post processor command, like Phase, also noting the
+// CPU time it used; call the returned function once it has exited.
+func (p *JobProfile) Command(phase string) func(*os.ProcessState) {
+	if p == nil {
+		return func(*os.ProcessState) {}
+	}
+	start := time.Now()
+	return func(ps *os.ProcessState) {
+		span := Span{Phase: phase, Start: start, Duration: time.Since(start)}
+		if ps != nil {
+			span.CPU = ps.UserTime() + ps.SystemTime()
+		}
+		p.lock.Lock()
+		p.Spans = append(p.Spans, span)
+		p.lock.Unlock()
+	}
+}
+
+// Command times a post processor command; see JobProfile.Command.
+func (qi *QueueItem) Command(phase string) func(*os.ProcessState) {
+	return qi.Profile.Command(phase)
+}
+
+// Phase times a phase of the job's work; see JobProfile.Phase.
+func (qi *QueueItem) Phase(phase string) func() {
+	return qi.Profile.Phase(phase)
+}
+
+// ranked is a name with a total duration, for the summary tables.
+type ranked struct {
+	name  string
+	total time.Duration
+	count int
+}
+
+func rank(m map[string]*ranked, n int) []*ranked {
+	list := []*ranked{}
+	for _, r := range m {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].total == list[j].total {
+			return list[i].name < list[j].name
+		}
+		return list[i].total > list[j].total
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// Profiles returns the profiles of every finished job, in finishing order.
+func (qt *QueueTracker) Profiles() []*JobProfile {
+	qt.lock.Lock()
+	defer qt.lock.Unlock()
+	return append([]*JobProfile{}, qt.profiles...)
+}
+
+// Summary reports the slowest files, locales and phases (top n of each),
+// and compares the total time spent in jobs with the wall clock time.
+// Job time is measured by the clock; the CPU time is reported apart, for
+// post processors (per command) and for fsbuilder itself.  The latter is
+// for the whole process since StartQueue, as jobs run side by side.
+func (qt *QueueTracker) Summary(n int) string {
+	profiles := qt.Profiles()
+	if len(profiles) == 0 {
+		return "No jobs were run.\n"
+	}
+
+	byFile := make(map[string]*ranked)
+	byLocale := make(map[string]*ranked)
+	byPhase := make(map[string]*ranked)
+	add := func(m map[string]*ranked, name string, d time.Duration) {
+		if m[name] == nil {
+			m[name] = &ranked{name: name}
+		}
+		m[name].total += d
+		m[name].count++
+	}
+
+	var busy, commands time.Duration
+	first, last := profiles[0].Start, profiles[0].Start
+	for _, p := range profiles {
+		busy += p.Duration
+		add(byFile, p.File, p.Duration)
+		add(byLocale, p.Locale, p.Duration)
+		for _, span := range p.Spans {
+			add(byPhase, span.Phase, span.Duration)
+			commands += span.CPU
+		}
+		if p.Start.Before(first) {
+			first = p.Start
+		}
+		if end := p.Start.Add(p.Duration); end.After(last) {
+			last = end
+		}
+	}
+	wall := last.Sub(first)
+
+	b := &bytes.Buffer{}
+	table := func(title string, m map[string]*ranked) {
+		fmt.Fprintf(b, "%s:\n", title)
+		for _, r := range rank(m, n) {
+			fmt.Fprintf(b, "  %12v  %5d  %s\n", r.total.Round(time.Microsecond), r.count, r.name)
+		}
+	}
+	fmt.Fprintf(b, "%d jobs; %v job time (sum of jobs), %v wall clock", len(profiles), busy.Round(time.Millisecond), wall.Round(time.Millisecond))
+	if wall > 0 {
+		fmt.Fprintf(b, " (%.1fx parallel)", float64(busy)/float64(wall))
+	}
+	fmt.Fprintf(b, "\n")
+	fmt.Fprintf(b, "CPU: %v in fsbuilder, %v in post processors\n", (processCPU() - qt.cpu).Round(time.Millisecond), commands.Round(time.Millisecond))
+	table("Slowest files", byFile)
+	table("Slowest locales", byLocale)
+	table("Slowest phases", byPhase)
+	return b.String()
+}
+
+// traceEvent is a single "complete" (ph=X) event in the Chrome
+// Trace Event Format.
+type traceEvent struct {
+	Name string            `json:"name"`
+	Cat  string            `json:"cat"`
+	Ph   string            `json:"ph"`
+	Ts   int64             `json:"ts"`  // microseconds
+	Dur  int64             `json:"dur"` // microseconds
+	Pid  int               `json:"pid"`
+	Tid  int               `json:"tid"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+// WriteTrace writes every job and phase as Chrome trace events, which can
+// be opened in chrome://tracing or https://ui.perfetto.dev.
+// Each worker is shown as a thread.
+func (qt *QueueTracker) WriteTrace(fn string) error {
+	profiles := qt.Profiles()
+	events := []traceEvent{}
+	if len(profiles) > 0 {
+		origin := profiles[0].Start
+		for _, p := range profiles {
+			if p.Start.Before(origin) {
+				origin = p.Start
+			}
+		}
+		us := func(t time.Time) int64 { return t.Sub(origin).Microseconds() }
+		for _, p := range profiles {
+			args := map[string]string{"locale": p.Locale}
+			if p.BlockedBy != "" {
+				args["blockedBy"] = p.BlockedBy
+			}
+			events = append(events, traceEvent{
+				Name: p.Name, Cat: "job", Ph: "X",
+				Ts: us(p.Start), Dur: p.Duration.Microseconds(),
+				Pid: 1, Tid: p.Worker, Args: args,
+			})
+			for _, span := range p.Spans {
+				e := traceEvent{
+					Name: span.Phase, Cat: "phase", Ph: "X",
+					Ts: us(span.Start), Dur: span.Duration.Microseconds(),
+					Pid: 1, Tid: p.Worker,
+				}
+				if span.CPU > 0 {
+					e.Args = map[string]string{"cpu": span.CPU.String()}
+				}
+				events = append(events, e)
+			}
+		}
+	}
+
+	b, err := json.Marshal(struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}{events})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn, b, 0644)
+}
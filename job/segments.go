@@ -0,0 +1,89 @@
+package job
+
+import (
+	"strings"
+
+	"github.com/falling-sky/fsbuilder/po"
+)
+
+// Segment is a piece of an expanded template: either literal text, or
+// the inside of a {{ placeholder }} that is to be translated.
+type Segment struct {
+	Text        string
+	Placeholder bool
+}
+
+// Segments is a template split into literal text and placeholders.
+type Segments []Segment
+
+// Tokenize splits content into literal text and {{ placeholders }}, in a
+// single scan.  A placeholder ends at the first "}}" after its "{{"; an
+// unterminated "{{" is left as literal text.
+func Tokenize(content string) Segments {
+	segments := Segments{}
+	for len(content) > 0 {
+		start := strings.Index(content, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(content[start+2:], "}}")
+		if end < 0 {
+			break
+		}
+		end += start + 2
+		if start > 0 {
+			segments = append(segments, Segment{Text: content[:start]})
+		}
+		segments = append(segments, Segment{Text: content[start+2 : end], Placeholder: true})
+		content = content[end+2:]
+	}
+	if len(content) > 0 {
+		segments = append(segments, Segment{Text: content})
+	}
+	return segments
+}
+
+// Placeholders returns the text of every placeholder, in order.
+func (segments Segments) Placeholders() []string {
+	ret := []string{}
+	for _, s := range segments {
+		if s.Placeholder {
+			ret = append(ret, s.Text)
+		}
+	}
+	return ret
+}
+
+// Translate produces the output for one locale: literal text is copied,
+// and each placeholder is replaced with its translation (or the original
+// text).  Translations are never rescanned for placeholders.
+func (segments Segments) Translate(f *po.File, escapequotes bool) string {
+	b := &strings.Builder{}
+	size := 0
+	for _, s := range segments {
+		size += len(s.Text)
+	}
+	b.Grow(size + size/4)
+
+	for _, s := range segments {
+		if s.Placeholder {
+			b.WriteString(f.Translate(s.Text, escapequotes))
+		} else {
+			b.WriteString(s.Text)
+		}
+	}
+	return b.String()
+}
+
+// String reassembles the original (untranslated) content.
+func (segments Segments) String() string {
+	b := &strings.Builder{}
+	for _, s := range segments {
+		if s.Placeholder {
+			b.WriteString("{{" + s.Text + "}}")
+		} else {
+			b.WriteString(s.Text)
+		}
+	}
+	return b.String()
+}
@@ -68,6 +68,20 @@ func parseHeaders(s string) (MapHeaders, error) {
 	return h, nil
 }
 
+// obsolete returns an obsolete ("#~ msgid ...") entry without its "#~"
+// markers, ready for parseChunk; or false if chunk is not one.
+func obsolete(chunk string) (string, bool) {
+	lines := []string{}
+	for _, line := range strings.Split(chunk, "\n") {
+		if strings.HasPrefix(line, "#~") {
+			lines = append(lines, strings.TrimSpace(strings.TrimPrefix(line, "#~")))
+		} else if !strings.HasPrefix(line, "#") && line != "" {
+			return "", false
+		}
+	}
+	return strings.Join(lines, "\n"), len(lines) > 0
+}
+
 // Load a .PO file into memory.
 func Load(fn string) (*File, error) {
 
@@ -86,6 +100,17 @@ func Load(fn string) (*File, error) {
 
 	for _, chunk := range chunks {
 		//	log.Printf("Chunk: %s", chunk)
+		if entry, ok := obsolete(chunk); ok {
+			record, err := parseChunk(entry)
+			if err != nil {
+				return nil, fmt.Errorf("Parsing chunk from %s: %s", fn, err)
+			}
+			if f.Obsolete == nil {
+				f.Obsolete = make(MapStringRecord)
+			}
+			f.Obsolete[record.MsgID] = record
+			continue
+		}
 		record, err := parseChunk(chunk)
 		if err != nil {
 			return nil, fmt.Errorf("Parsing chunk from %s: %s", fn, err)
@@ -122,7 +147,8 @@ func Load(fn string) (*File, error) {
 
 // LoadAll loads a .pot file, and a directory of .po files.
 // The .pot file is mostly used for statistics.
-func LoadAll(potfn string, root string) (*Files, error) {
+// Any pseudo-locales named (see PseudoLocales) are generated as well.
+func LoadAll(potfn string, root string, pseudo ...string) (*Files, error) {
 	combined := &Files{}
 	combined.ByLanguage = make(MapStringFile)
 
@@ -183,5 +209,12 @@ func LoadAll(potfn string, root string) (*Files, error) {
 
 	}
 
+	for _, locale := range pseudo {
+		if !IsPseudo(locale) {
+			return nil, fmt.Errorf("%s is not a pseudo-locale (%s)", locale, strings.Join(PseudoLocales, ", "))
+		}
+		combined.ByLanguage[locale] = NewPseudo(locale)
+	}
+
 	return combined, nil
 }
@@ -39,6 +39,18 @@ func (combined *Files) Languages() []string {
 	return ret
 }
 
+// Published returns ByLanguage without the pseudo-locales; the locales
+// visitors are offered (ie by AddLanguage, or a language picker).
+func (combined *Files) Published() MapStringFile {
+	ret := make(MapStringFile)
+	for locale, f := range combined.ByLanguage {
+		if !IsPseudo(locale) {
+			ret[locale] = f
+		}
+	}
+	return ret
+}
+
 // GetLocale simply returns the locale name; ie en_US or pt_BR
 func (f *File) GetLocale() string {
 	s := f.Locale
@@ -66,6 +78,17 @@ func (f *File) GetLangName() string {
 	return s
 }
 
+// rtlLanguages are written right to left.
+var rtlLanguages = map[string]bool{"ar": true, "dv": true, "fa": true, "he": true, "ps": true, "ur": true, "yi": true}
+
+// GetDir returns the text direction; ie ltr or rtl
+func (f *File) GetDir() string {
+	if rtlLanguages[f.GetLang()] || f.Locale == PseudoLocaleRTL {
+		return "rtl"
+	}
+	return "ltr"
+}
+
 // GetLangPercentTranslated returns what percentage of the translation is done
 func (f *File) GetLangPercentTranslated() string {
 	s := f.PercentTranslated
@@ -96,6 +119,9 @@ func (f *File) Translate(input string, escapequotes bool) string {
 	if input == "percenttranslated" {
 		return f.GetLangPercentTranslated()
 	}
+	if input == "dir" {
+		return f.GetDir()
+	}
 
 	newtext := input
 
@@ -105,6 +131,9 @@ func (f *File) Translate(input string, escapequotes bool) string {
 			newtext = c
 		}
 	}
+	if f.Pseudo {
+		newtext = Pseudolocalize(input, f.GetDir() == "rtl")
+	}
 
 	if escapequotes {
 		newtext = strings.Replace(newtext, `"`, `\"`, -1)
@@ -131,7 +160,7 @@ func (f *File) Add(input string, context string, escapequotes bool) {
 	//	log.Printf("po Add input=%s context=%s escape=%v\n", input, context, escapequotes)
 
 	// Skip these, these will be dynamically responded to.
-	if input == "lang" || input == "langUC" || input == "locale" {
+	if input == "lang" || input == "langUC" || input == "locale" || input == "dir" {
 		return
 	}
 
@@ -166,8 +195,14 @@ func (f *File) Add(input string, context string, escapequotes bool) {
 }
 
 // ApacheAddLanguage  Generates the Apache "AddLanguage" text
+// Pseudo-locales are left out; they are only for those who ask by name.
 func (f *Files) ApacheAddLanguage() string {
-	list := append([]string{"en_US"}, f.Languages()...)
+	list := []string{"en_US"}
+	for _, locale := range f.Languages() {
+		if !IsPseudo(locale) {
+			list = append(list, locale)
+		}
+	}
 	text := ""
 	seen := make(map[string]bool)
 
@@ -1,6 +1,7 @@
 package po
 
 import (
+	"io/ioutil"
 	"testing"
 )
 
@@ -45,3 +46,68 @@ func TestLoadAll(t *testing.T) {
 	}
 	//t.Logf("%#v", multi.ByLanguage["pt_BR"])
 }
+
+func TestPseudolocalize(t *testing.T) {
+	var table = []struct {
+		in  string
+		rtl bool
+		out string
+	}{
+		{"Hello", false, "[Ĥéļļö ··]"},
+		{`Read <a href="/faq.html">this</a> &amp; that\n`, false, `[Ŕéåð <a href="/faq.html">ŧĥîš</a> &amp; ŧĥåŧ\n ·····]`},
+		{"ok", true, "[\u202eöķ ·\u202c]"},
+		{"2026", false, "[2026]"},
+	}
+	for _, tt := range table {
+		if found := Pseudolocalize(tt.in, tt.rtl); found != tt.out {
+			t.Errorf("Pseudolocalize(%q,%v)=%q, expected %q", tt.in, tt.rtl, found, tt.out)
+		}
+	}
+
+	f := NewPseudo(PseudoLocaleRTL)
+	if found := f.Translate("dir", false); found != "rtl" {
+		t.Errorf("Translate(dir)=%q, expected rtl", found)
+	}
+	if found := f.Translate("  Say   \"hi\" ", true); found != "[\u202eŠåý \\\"ĥî\\\" ··\u202c]" {
+		t.Errorf("Translate=%q", found)
+	}
+}
+
+func TestObsolete(t *testing.T) {
+	fn := t.TempDir() + "/fr.po"
+	ioutil.WriteFile(fn, []byte(`msgid ""
+msgstr "Language: fr_FR\n"
+
+msgid "slow"
+msgstr "lent"
+
+#, fuzzy
+#~ msgid "fast"
+#~ msgstr ""
+#~ "vite"
+`), 0644)
+	p, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.ByID["fast"]; ok {
+		t.Errorf("obsolete entry loaded as a translation")
+	}
+	if r := p.Obsolete["fast"]; r == nil || r.MsgStr != "vite" {
+		t.Errorf("Obsolete[fast]=%#v, expected vite", r)
+	}
+}
+
+func TestPublished(t *testing.T) {
+	files := &Files{ByLanguage: MapStringFile{
+		"fr_FR":      &File{Locale: "fr_FR"},
+		PseudoLocale: NewPseudo(PseudoLocale),
+	}}
+	if p := files.Published(); len(p) != 1 || p["fr_FR"] == nil {
+		t.Errorf("Published()=%v, expected just fr_FR", p)
+	}
+	expected := "AddLanguage en .en_US\nAddLanguage en-US .en_US\nAddLanguage fr .fr_FR\nAddLanguage fr-FR .fr_FR\n"
+	if found := files.ApacheAddLanguage(); found != expected {
+		t.Errorf("ApacheAddLanguage()=%q, expected %q", found, expected)
+	}
+}
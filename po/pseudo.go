@@ -0,0 +1,104 @@
+package po
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Pseudo-locales; see NewPseudo.
+const (
+	PseudoLocale    = "qps_PLOC"  // Accented, expanded, bracketed
+	PseudoLocaleRTL = "qps_PLOCM" // The same, shown right to left
+)
+
+// PseudoLocales lists the pseudo-locales LoadAll knows how to generate.
+var PseudoLocales = []string{PseudoLocale, PseudoLocaleRTL}
+
+// pseudoExpansion is how much longer pseudo-localized text gets; about
+// what German or Finnish needs.
+const pseudoExpansion = 0.35
+
+var pseudoAccents = map[rune]rune{
+	'A': 'Å', 'B': 'Ɓ', 'C': 'Ç', 'D': 'Ð', 'E': 'É', 'F': 'Ƒ', 'G': 'Ĝ', 'H': 'Ĥ', 'I': 'Î',
+	'J': 'Ĵ', 'K': 'Ķ', 'L': 'Ļ', 'M': 'Ṁ', 'N': 'Ñ', 'O': 'Ö', 'P': 'Þ', 'Q': 'Ǫ', 'R': 'Ŕ',
+	'S': 'Š', 'T': 'Ŧ', 'U': 'Û', 'V': 'Ṽ', 'W': 'Ŵ', 'X': 'Ẋ', 'Y': 'Ý', 'Z': 'Ž',
+	'a': 'å', 'b': 'ƀ', 'c': 'ç', 'd': 'ð', 'e': 'é', 'f': 'ƒ', 'g': 'ĝ', 'h': 'ĥ', 'i': 'î',
+	'j': 'ĵ', 'k': 'ķ', 'l': 'ļ', 'm': 'ɱ', 'n': 'ñ', 'o': 'ö', 'p': 'þ', 'q': 'ǫ', 'r': 'ŕ',
+	's': 'š', 't': 'ŧ', 'u': 'û', 'v': 'ṽ', 'w': 'ŵ', 'x': 'ẋ', 'y': 'ý', 'z': 'ž',
+}
+
+// IsPseudo reports whether a locale is one of the pseudo-locales.
+func IsPseudo(locale string) bool {
+	for _, p := range PseudoLocales {
+		if p == locale {
+			return true
+		}
+	}
+	return false
+}
+
+// Pseudolocalize makes text look translated while staying readable:
+// letters are accented, the text is padded by about a third, and the
+// result is wrapped in brackets; so that hardcoded (untranslated) strings,
+// truncation and layout problems stand out.  html tags, entities and
+// backslash escapes are left alone.  With rtl, the text is also forced to
+// display right to left.
+func Pseudolocalize(input string, rtl bool) string {
+	b := &strings.Builder{}
+	letters := 0
+	for i := 0; i < len(input); {
+		r, size := utf8.DecodeRuneInString(input[i:])
+		var end int
+		switch r {
+		case '<':
+			end = strings.IndexByte(input[i:], '>')
+		case '&':
+			end = strings.IndexByte(input[i:], ';')
+			if end >= 0 && strings.ContainsAny(input[i:i+end], " <") {
+				end = -1
+			}
+		case '\\':
+			end = 1
+		default:
+			end = -1
+		}
+		if end > 0 && i+end < len(input) {
+			b.WriteString(input[i : i+end+1])
+			i += end + 1
+			continue
+		}
+		if a, ok := pseudoAccents[r]; ok {
+			b.WriteRune(a)
+			letters++
+		} else {
+			b.WriteString(input[i : i+size])
+		}
+		i += size
+	}
+
+	text := b.String()
+	if pad := int(float64(letters)*pseudoExpansion + 0.999); pad > 0 {
+		text += " " + strings.Repeat("·", pad)
+	}
+	if rtl {
+		text = "\u202e" + text + "\u202c" // RIGHT-TO-LEFT OVERRIDE ... POP DIRECTIONAL FORMATTING
+	}
+	return "[" + text + "]"
+}
+
+// NewPseudo returns a translation file for a pseudo-locale.  Nothing is
+// stored in it; every string is pseudo-localized as it is translated, so
+// strings that are new to this build are covered too.
+func NewPseudo(locale string) *File {
+	f := &File{
+		ByID:              make(MapStringRecord),
+		Headers:           MapHeaders{"Language": locale},
+		Locale:            locale,
+		Language:          "Pseudo",
+		PercentTranslated: "100.00%",
+		Pseudo:            true,
+	}
+	f.ByID[""] = &Record{MsgStr: "Language: " + locale + "\n"}
+	f.InOrder = []string{""}
+	return f
+}
@@ -25,6 +25,8 @@ type File struct {
 	Translated        int
 	OutOf             int
 	PercentTranslated string
+	Pseudo            bool            // Translations are generated; see NewPseudo
+	Obsolete          MapStringRecord // "#~" entries; kept by translators, not used
 	lock              sync.Mutex
 }
 
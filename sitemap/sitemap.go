@@ -0,0 +1,120 @@
+package sitemap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// Page is a single page of the site, as built for every locale.
+type Page struct {
+	Name    string // Output name, ie faq.html or index.html
+	Lastmod string // Date of the last change, in ISO 8601 format; optional
+}
+
+// URL returns the path a page is served as, for a locale; "" being the
+// content negotiated (default) version.  index.html is served as its
+// directory.
+func URL(name string, locale string) string {
+	if locale != "" {
+		return "/" + name + "." + locale
+	}
+	if name == "index.html" {
+		return "/"
+	}
+	if strings.HasSuffix(name, "/index.html") {
+		return "/" + strings.TrimSuffix(name, "index.html")
+	}
+	return "/" + name
+}
+
+// Hreflang converts a locale to a language tag; ie pt_BR becomes pt-BR.
+func Hreflang(locale string) string {
+	return strings.Replace(locale, "_", "-", -1)
+}
+
+type link struct {
+	Rel      string `xml:"rel,attr"`
+	Hreflang string `xml:"hreflang,attr"`
+	Href     string `xml:"href,attr"`
+}
+
+type url struct {
+	Loc     string `xml:"loc"`
+	Lastmod string `xml:"lastmod,omitempty"`
+	Links   []link `xml:"xhtml:link"`
+}
+
+type urlset struct {
+	XMLName xml.Name `xml:"urlset"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Xhtml   string   `xml:"xmlns:xhtml,attr"`
+	URLs    []url    `xml:"url"`
+}
+
+// Generate returns sitemap.xml for the pages.  Every page is listed once
+// as its content negotiated URL, and once per locale; each with xhtml:link
+// alternates pointing at every locale (and x-default).  baseURL is
+// prepended to each path, ie "https://test-ipv6.com".
+func Generate(baseURL string, pages []Page, locales []string) ([]byte, error) {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	locales = append([]string{}, locales...)
+	sort.Strings(locales)
+	pages = append([]Page{}, pages...)
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Name < pages[j].Name })
+
+	set := urlset{
+		Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9",
+		Xhtml: "http://www.w3.org/1999/xhtml",
+	}
+	for _, p := range pages {
+		links := []link{{Rel: "alternate", Hreflang: "x-default", Href: baseURL + URL(p.Name, "")}}
+		for _, locale := range locales {
+			links = append(links, link{Rel: "alternate", Hreflang: Hreflang(locale), Href: baseURL + URL(p.Name, locale)})
+		}
+		for _, locale := range append([]string{""}, locales...) {
+			set.URLs = append(set.URLs, url{Loc: baseURL + URL(p.Name, locale), Lastmod: p.Lastmod, Links: links})
+		}
+	}
+
+	b := &bytes.Buffer{}
+	b.WriteString(xml.Header)
+	e := xml.NewEncoder(b)
+	e.Indent("", "  ")
+	if err := e.Encode(set); err != nil {
+		return nil, err
+	}
+	b.WriteString("\n")
+	return b.Bytes(), nil
+}
+
+// Robots returns robots.txt: the configured lines, followed by a pointer
+// to the sitemap (if baseURL is known).
+func Robots(lines []string, baseURL string) []byte {
+	b := &bytes.Buffer{}
+	for _, line := range lines {
+		fmt.Fprintf(b, "%s\n", line)
+	}
+	if baseURL != "" {
+		fmt.Fprintf(b, "\nSitemap: %s/sitemap.xml\n", strings.TrimSuffix(baseURL, "/"))
+	}
+	return b.Bytes()
+}
+
+// Write saves sitemap.xml and robots.txt into outputDir.
+// Without a baseURL, only robots.txt is written; sitemaps need absolute URLs.
+func Write(outputDir string, baseURL string, robots []string, pages []Page, locales []string) error {
+	if baseURL != "" {
+		b, err := Generate(baseURL, pages, locales)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(outputDir+"/sitemap.xml", b, 0644); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(outputDir+"/robots.txt", Robots(robots, baseURL), 0644)
+}
@@ -0,0 +1,58 @@
+package sitemap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestURL(t *testing.T) {
+	var table = []struct {
+		name   string
+		locale string
+		out    string
+	}{
+		{"index.html", "", "/"},
+		{"index.html", "fr_FR", "/index.html.fr_FR"},
+		{"faq.html", "", "/faq.html"},
+		{"ip/index.html", "", "/ip/"},
+	}
+	for _, tt := range table {
+		if found := URL(tt.name, tt.locale); found != tt.out {
+			t.Errorf("URL(%q,%q)=%q, expected %q", tt.name, tt.locale, found, tt.out)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	pages := []Page{{Name: "faq.html"}, {Name: "index.html", Lastmod: "2026-10-19T15:13:52+00:00"}}
+	b, err := Generate("https://example.com/", pages, []string{"pt_BR", "en_US"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+	for _, want := range []string{
+		`<loc>https://example.com/</loc>`,
+		`<loc>https://example.com/index.html.pt_BR</loc>`,
+		`<lastmod>2026-10-19T15:13:52+00:00</lastmod>`,
+		`<xhtml:link rel="alternate" hreflang="pt-BR" href="https://example.com/faq.html.pt_BR"></xhtml:link>`,
+		`<xhtml:link rel="alternate" hreflang="x-default" href="https://example.com/faq.html"></xhtml:link>`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Generate: missing %s in\n%s", want, s)
+		}
+	}
+	if n := strings.Count(s, "<url>"); n != 6 {
+		t.Errorf("Generate: %d urls, expected 6", n)
+	}
+	if strings.Index(s, "faq.html") > strings.Index(s, "index.html") {
+		t.Errorf("Generate: pages should be sorted")
+	}
+}
+
+func TestRobots(t *testing.T) {
+	found := string(Robots([]string{"User-agent: *", "Disallow:"}, "https://example.com"))
+	expected := "User-agent: *\nDisallow:\n\nSitemap: https://example.com/sitemap.xml\n"
+	if found != expected {
+		t.Errorf("Robots=%q, expected %q", found, expected)
+	}
+}
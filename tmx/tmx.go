@@ -0,0 +1,173 @@
+package tmx
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"sort"
+	"strings"
+
+	"github.com/falling-sky/fsbuilder/po"
+)
+
+// SourceLocale is the language every msgid is written in.
+const SourceLocale = "en_US"
+
+// Unit is one source string, with every translation of it.
+type Unit struct {
+	MsgID        string
+	Translations map[string]string // By locale, ie fr_FR
+	Obsolete     bool              // Not in the .pot file any more
+}
+
+// Units collects the translations of every msgid in files, including
+// obsolete ones ("#~" entries, and msgids no longer in the .pot file).
+// Pseudo-locales are left out.  Sorted by msgid.
+func Units(files *po.Files) []Unit {
+	byID := make(map[string]*Unit)
+	add := func(locale string, records po.MapStringRecord) {
+		for msgid, r := range records {
+			if msgid == "" || r.MsgStr == "" {
+				continue
+			}
+			u := byID[msgid]
+			if u == nil {
+				_, current := files.Pot.ByID[msgid]
+				u = &Unit{MsgID: msgid, Translations: make(map[string]string), Obsolete: !current}
+				byID[msgid] = u
+			}
+			if _, ok := u.Translations[locale]; !ok {
+				u.Translations[locale] = r.MsgStr
+			}
+		}
+	}
+	for _, locale := range files.Languages() {
+		f := files.ByLanguage[locale]
+		if f.Pseudo {
+			continue
+		}
+		add(locale, f.ByID)
+		add(locale, f.Obsolete)
+	}
+
+	ret := []Unit{}
+	for _, u := range byID {
+		ret = append(ret, *u)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].MsgID < ret[j].MsgID })
+	return ret
+}
+
+// Locales returns every locale translated in units, sorted.
+func Locales(units []Unit) []string {
+	seen := make(map[string]bool)
+	ret := []string{}
+	for _, u := range units {
+		for locale := range u.Translations {
+			if !seen[locale] {
+				seen[locale] = true
+				ret = append(ret, locale)
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// lang converts a locale to a language tag; ie pt_BR becomes pt-BR.
+func lang(locale string) string {
+	return strings.Replace(locale, "_", "-", -1)
+}
+
+type prop struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type tuv struct {
+	Lang string `xml:"xml:lang,attr"`
+	Seg  string `xml:"seg"`
+}
+
+type tu struct {
+	Props []prop `xml:"prop"`
+	Tuvs  []tuv  `xml:"tuv"`
+}
+
+type header struct {
+	CreationTool        string `xml:"creationtool,attr"`
+	CreationToolVersion string `xml:"creationtoolversion,attr"`
+	SegType             string `xml:"segtype,attr"`
+	OTmf                string `xml:"o-tmf,attr"`
+	AdminLang           string `xml:"adminlang,attr"`
+	SrcLang             string `xml:"srclang,attr"`
+	DataType            string `xml:"datatype,attr"`
+}
+
+type document struct {
+	XMLName xml.Name `xml:"tmx"`
+	Version string   `xml:"version,attr"`
+	Header  header   `xml:"header"`
+	Units   []tu     `xml:"body>tu"`
+}
+
+// Generate returns a TMX 1.4 translation memory of units; one tu per
+// msgid, with a tuv for the source and for each translation.  Obsolete
+// units are marked with an x-obsolete prop.
+func Generate(units []Unit) ([]byte, error) {
+	doc := document{
+		Version: "1.4",
+		Header: header{
+			CreationTool:        "fsbuilder",
+			CreationToolVersion: "1",
+			SegType:             "block",
+			OTmf:                "PO",
+			AdminLang:           lang(SourceLocale),
+			SrcLang:             lang(SourceLocale),
+			DataType:            "html",
+		},
+	}
+	for _, u := range units {
+		t := tu{Tuvs: []tuv{{Lang: lang(SourceLocale), Seg: u.MsgID}}}
+		if u.Obsolete {
+			t.Props = append(t.Props, prop{Type: "x-obsolete", Value: "true"})
+		}
+		locales := []string{}
+		for locale := range u.Translations {
+			locales = append(locales, locale)
+		}
+		sort.Strings(locales)
+		for _, locale := range locales {
+			t.Tuvs = append(t.Tuvs, tuv{Lang: lang(locale), Seg: u.Translations[locale]})
+		}
+		doc.Units = append(doc.Units, t)
+	}
+
+	b, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(b, '\n')...), nil
+}
+
+// CSV returns units as a glossary: a column for the source, one per
+// locale, and whether the string is obsolete.
+func CSV(units []Unit) ([]byte, error) {
+	locales := Locales(units)
+	b := &bytes.Buffer{}
+	w := csv.NewWriter(b)
+	w.Write(append(append([]string{SourceLocale}, locales...), "obsolete"))
+	for _, u := range units {
+		row := []string{u.MsgID}
+		for _, locale := range locales {
+			row = append(row, u.Translations[locale])
+		}
+		obsolete := ""
+		if u.Obsolete {
+			obsolete = "yes"
+		}
+		w.Write(append(row, obsolete))
+	}
+	w.Flush()
+	return b.Bytes(), w.Error()
+}
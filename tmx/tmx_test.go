@@ -0,0 +1,76 @@
+package tmx
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/falling-sky/fsbuilder/po"
+)
+
+func testFiles() *po.Files {
+	record := func(id, str string) *po.Record { return &po.Record{MsgID: id, MsgStr: str} }
+	return &po.Files{
+		Pot: &po.File{ByID: po.MapStringRecord{
+			"":     record("", "header"),
+			"slow": record("slow", ""),
+			"fast": record("fast", ""),
+		}},
+		ByLanguage: po.MapStringFile{
+			"fr_FR": &po.File{
+				ByID: po.MapStringRecord{
+					"":     record("", "Language: fr_FR"),
+					"slow": record("slow", "lent"),
+					"fast": record("fast", ""),
+					"old":  record("old", "vieux"),
+				},
+				Obsolete: po.MapStringRecord{"older": record("older", "plus vieux")},
+			},
+			"pt_BR": &po.File{ByID: po.MapStringRecord{
+				"slow": record("slow", "lento"),
+				"fast": record("fast", "rápido & <b>"),
+			}},
+			po.PseudoLocale: po.NewPseudo(po.PseudoLocale),
+		},
+	}
+}
+
+func TestUnits(t *testing.T) {
+	got := []string{}
+	for _, u := range Units(testFiles()) {
+		got = append(got, u.MsgID+":"+strings.Join(Locales([]Unit{u}), ","))
+		if u.Obsolete != (u.MsgID == "old" || u.MsgID == "older") {
+			t.Errorf("%s: Obsolete=%v", u.MsgID, u.Obsolete)
+		}
+	}
+	expected := "fast:pt_BR old:fr_FR older:fr_FR slow:fr_FR,pt_BR"
+	if strings.Join(got, " ") != expected {
+		t.Errorf("Units=%v, expected %v", got, expected)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	b, err := Generate(Units(testFiles()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+	for _, want := range []string{
+		`<tmx version="1.4">`,
+		`srclang="en-US"`,
+		`<tuv xml:lang="pt-BR">`,
+		`<seg>rápido &amp; &lt;b&gt;</seg>`,
+		`<prop type="x-obsolete">true</prop>`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Generate is missing %s:\n%s", want, s)
+		}
+	}
+
+	b, err = CSV(Units(testFiles()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "en_US,fr_FR,pt_BR,obsolete\nfast,,rápido & <b>,\n") {
+		t.Errorf("CSV=%s", b)
+	}
+}